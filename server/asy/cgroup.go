@@ -0,0 +1,174 @@
+package asy
+
+import (
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// CgroupConfig describes cgroup v2 leaves that are created for each task.
+type CgroupConfig struct {
+    // Parent is the cgroup under which task cgroups are created,
+    // like "/sys/fs/cgroup/asyonline". It must be writable by the server
+    // and have "memory", "cpu" and "pids" controllers enabled in its
+    // cgroup.subtree_control. Empty Parent disables cgroups.
+    Parent string
+    // memory.max in bytes, 0 means no limit
+    MemoryMax uint64
+    // cpu.max as a number of CPUs, 0 means no limit
+    CPUMax float64
+    // pids.max, 0 means no limit
+    PidsMax uint64
+}
+
+const cpuPeriod = 100000 // microseconds
+
+type cgroup struct {
+    path string
+    dir  *os.File // to be passed as SysProcAttr.CgroupFD
+}
+
+func newCgroup(config *CgroupConfig, name string) (*cgroup, error) {
+    path := filepath.Join(config.Parent, name)
+    if err := os.Mkdir(path, 0o755); err != nil {
+        return nil, err
+    }
+    cg := &cgroup{path: path}
+    var err error
+    set := func(file string, value string) {
+        if err != nil {
+            return
+        }
+        err = ioutil.WriteFile(
+            filepath.Join(path, file), []byte(value), 0o644)
+    }
+    if config.MemoryMax > 0 {
+        set("memory.max", strconv.FormatUint(config.MemoryMax, 10))
+        if err == nil {
+            // without swap the limit is enforced by OOM killer,
+            // which is reported in memory.events
+            if errx := ioutil.WriteFile(filepath.Join(path, "memory.swap.max"),
+                []byte("0"), 0o644); errx != nil && !os.IsNotExist(errx) {
+                err = errx
+            }
+        }
+    }
+    if config.CPUMax > 0 {
+        set("cpu.max", fmt.Sprintf("%d %d",
+            int64(config.CPUMax*cpuPeriod), cpuPeriod))
+    }
+    if config.PidsMax > 0 {
+        set("pids.max", strconv.FormatUint(config.PidsMax, 10))
+    }
+    if err == nil {
+        cg.dir, err = os.OpenFile(path, unix.O_PATH|unix.O_DIRECTORY, 0)
+    }
+    if err != nil {
+        if errx := os.Remove(path); errx != nil {
+            return nil, errx
+        }
+        return nil, err
+    }
+    return cg, nil
+}
+
+// kill kills all processes in the cgroup
+func (cg *cgroup) kill() error {
+    err := ioutil.WriteFile(
+        filepath.Join(cg.path, "cgroup.kill"), []byte("1"), 0o644)
+    if err == nil || !os.IsNotExist(err) {
+        return err
+    }
+    // cgroup.kill is absent before Linux 5.14
+    procs, err := ioutil.ReadFile(filepath.Join(cg.path, "cgroup.procs"))
+    if err != nil {
+        return err
+    }
+    for _, field := range strings.Fields(string(procs)) {
+        pid, err := strconv.Atoi(field)
+        if err != nil {
+            return err
+        }
+        err = unix.Kill(pid, unix.SIGKILL)
+        if err != nil && !errors.Is(err, unix.ESRCH) {
+            return err
+        }
+    }
+    return nil
+}
+
+// reap kills all processes in the cgroup and waits until they are gone
+func (cg *cgroup) reap() error {
+    const (
+        pollEvery   time.Duration = 10e6 // 10ms
+        giveUpAfter time.Duration = 1e9  // 1s
+    )
+    deadline := time.Now().Add(giveUpAfter)
+    for {
+        if err := cg.kill(); err != nil {
+            return err
+        }
+        populated, err := cg.event("cgroup.events", "populated")
+        if err != nil {
+            return err
+        }
+        if populated == 0 {
+            return nil
+        }
+        if time.Now().After(deadline) {
+            return errors.New("cgroup did not become empty")
+        }
+        time.Sleep(pollEvery)
+    }
+}
+
+// oomKilled tells whether any process was killed by OOM killer
+func (cg *cgroup) oomKilled() bool {
+    count, err := cg.event("memory.events", "oom_kill")
+    if err != nil {
+        return false
+    }
+    return count > 0
+}
+
+// pidsExceeded tells whether a fork failed at pids.max
+func (cg *cgroup) pidsExceeded() bool {
+    count, err := cg.event("pids.events", "max")
+    if err != nil {
+        return false
+    }
+    return count > 0
+}
+
+// event reads a value from a flat keyed file like cgroup.events
+func (cg *cgroup) event(file, key string) (int64, error) {
+    contents, err := ioutil.ReadFile(filepath.Join(cg.path, file))
+    if err != nil {
+        return 0, err
+    }
+    scanner := bufio.NewScanner(bytes.NewReader(contents))
+    for scanner.Scan() {
+        fields := strings.Fields(scanner.Text())
+        if len(fields) == 2 && fields[0] == key {
+            return strconv.ParseInt(fields[1], 10, 64)
+        }
+    }
+    return 0, fmt.Errorf("%s: no %q key", file, key)
+}
+
+// remove removes the (already empty) cgroup
+func (cg *cgroup) remove() error {
+    if cg.dir != nil {
+        cg.dir.Close()
+    }
+    return os.Remove(cg.path)
+}
@@ -0,0 +1,39 @@
+package asy
+
+import (
+    "asyonline/server/server/results"
+)
+
+// Config holds settings of a backend, shared by all its tasks.
+type Config struct {
+    Runner Runner
+    // directory for working directories of tasks
+    TempDir string
+    // upper limits on duration of tasks, seconds
+    MaxDuration            float64
+    MaxInteractiveDuration float64
+    // upper limit on output of a task, bytes
+    MaxOutput int
+    // allowed output formats, the first one is the default
+    Formats []string
+    Limits  Limits
+    Cgroup  CgroupConfig
+    // outcomes of tasks that succeeded, replayed to identical tasks
+    // instead of running them; nil to run every task
+    Results *results.Store
+}
+
+// Formats that Asymptote can produce without a display
+var AllFormats = []string{"svg", "pdf", "png"}
+
+func DefaultConfig() *Config {
+    return &Config{
+        Runner:                 &DirectRunner{Path: "/usr/bin/asy"},
+        TempDir:                "/tmp",
+        MaxDuration:            30,
+        MaxInteractiveDuration: 600,
+        MaxOutput:              1 << 19,
+        Formats:                AllFormats,
+        Limits:                 DefaultLimits,
+    }
+}
@@ -0,0 +1,177 @@
+package asy
+
+import (
+    "bytes"
+    "fmt"
+    "sync"
+    "syscall"
+    "time"
+
+    "golang.org/x/sys/unix"
+
+    "asyonline/server/server/reply"
+)
+
+// Limits are resource limits of the Asymptote process; its descendants
+// inherit them. Zero values mean no limit.
+type Limits struct {
+    // CPU time, rounded up to whole seconds (RLIMIT_CPU)
+    CPUTime time.Duration
+    // virtual memory size in bytes (RLIMIT_AS)
+    AddressSpace uint64
+    // size of any single written file in bytes (RLIMIT_FSIZE)
+    FileSize uint64
+    // number of processes (RLIMIT_NPROC); beware that Linux counts
+    // all processes and threads of the user, including the server itself
+    Processes uint64
+    // number of open file descriptors (RLIMIT_NOFILE)
+    OpenFiles uint64
+}
+
+var DefaultLimits = Limits{
+    CPUTime:      60e9,    // 60s
+    AddressSpace: 2 << 30, // 2GiB
+    FileSize:     64 << 20,
+    Processes:    0,
+    OpenFiles:    256,
+}
+
+// set sets limits of the calling process, right before it executes
+// Asymptote. The syscall package is used, so that the Go runtime does not
+// restore its own RLIMIT_NOFILE on exec.
+func (limits *Limits) set() error {
+    return limits.each(func(resource int, rlimit *unix.Rlimit) error {
+        return syscall.Setrlimit(resource,
+            &syscall.Rlimit{Cur: rlimit.Cur, Max: rlimit.Max})
+    })
+}
+
+// each calls set for every limit that is not zero
+func (limits *Limits) each(
+    set func(resource int, rlimit *unix.Rlimit) error,
+) error {
+    var err error
+    each := func(resource int, value uint64, grace uint64) {
+        if err != nil || value == 0 {
+            return
+        }
+        err = set(resource, &unix.Rlimit{Cur: value, Max: value + grace})
+    }
+    // at the hard limit the process is killed without a trace,
+    // while exceeding the soft limit results in SIGXCPU
+    each(unix.RLIMIT_CPU, limits.cpuSeconds(), 1)
+    each(unix.RLIMIT_AS, limits.AddressSpace, 0)
+    each(unix.RLIMIT_FSIZE, limits.FileSize, 0)
+    each(unix.RLIMIT_NPROC, limits.Processes, 0)
+    each(unix.RLIMIT_NOFILE, limits.OpenFiles, 0)
+    return err
+}
+
+// exceeded tells which limit (if any) caused termination of the process.
+// Limits that are enforced with signals are told by the status; the rest
+// make system calls fail, which is told by messages in error output.
+// As the output may be printed by the user, such messages only count
+// if the process crashed, see crashSignals.
+func (limits *Limits) exceeded(status syscall.WaitStatus,
+    output *limitScanner,
+) error {
+    if !status.Signaled() {
+        return nil
+    }
+    switch status.Signal() {
+    case unix.SIGXCPU:
+        return reply.Error(fmt.Sprintf(
+            "Process reached CPU time limit (%ds)", limits.cpuSeconds()))
+    case unix.SIGXFSZ:
+        return reply.Error(fmt.Sprintf(
+            "Process reached file size limit (%dB)", limits.FileSize))
+    }
+    if !crashSignals[status.Signal()] {
+        return nil
+    }
+    switch {
+    case limits.AddressSpace != 0 && output.found(limitAddressSpace):
+        return reply.Error(fmt.Sprintf(
+            "Process reached address space limit (%dB)",
+            limits.AddressSpace))
+    case limits.Processes != 0 && output.found(limitProcesses):
+        return reply.Error(fmt.Sprintf(
+            "Process reached process limit (%d)", limits.Processes))
+    case limits.OpenFiles != 0 && output.found(limitOpenFiles):
+        return reply.Error(fmt.Sprintf(
+            "Process reached open file limit (%d)", limits.OpenFiles))
+    }
+    return nil
+}
+
+// crashSignals terminate Asymptote and TeX when they fail for limits,
+// like on aborts after failed allocations; unlike output, a program can
+// only cause them by crashing Asymptote
+var crashSignals = map[syscall.Signal]bool{
+    unix.SIGABRT: true,
+    unix.SIGSEGV: true,
+    unix.SIGBUS:  true,
+}
+
+// limits that are told by messages in output
+const (
+    limitAddressSpace = iota
+    limitProcesses
+    limitOpenFiles
+    numLimits
+)
+
+// limitMessages are printed (in lower case) by Asymptote, its garbage
+// collector, TeX or the C library when system calls fail for limits:
+// ENOMEM for the address space, EAGAIN of fork for processes, and EMFILE
+// for open files
+var limitMessages = [numLimits][]string{
+    limitAddressSpace: {"out of memory", "cannot allocate memory",
+        "bad_alloc", "memory exhausted"},
+    limitProcesses: {"resource temporarily unavailable"},
+    limitOpenFiles: {"too many open files"},
+}
+
+// longest message of limitMessages, which may be split between reads
+const limitMessageMax = 32
+
+// limitScanner looks for limitMessages in error output of the process
+type limitScanner struct {
+    mutex sync.Mutex
+    // ends of streams, by names
+    tails map[string][]byte
+    seen  [numLimits]bool
+}
+
+func newLimitScanner() *limitScanner {
+    return &limitScanner{tails: make(map[string][]byte)}
+}
+
+// scan looks at the next output of stream
+func (s *limitScanner) scan(stream string, output []byte) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    text := bytes.ToLower(append(s.tails[stream], output...))
+    for limit, messages := range limitMessages {
+        for _, message := range messages {
+            if bytes.Contains(text, []byte(message)) {
+                s.seen[limit] = true
+            }
+        }
+    }
+    if len(text) > limitMessageMax {
+        text = text[len(text)-limitMessageMax:]
+    }
+    s.tails[stream] = text
+}
+
+// found tells whether a message of limit was seen
+func (s *limitScanner) found(limit int) bool {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    return s.seen[limit]
+}
+
+func (limits *Limits) cpuSeconds() uint64 {
+    return uint64((limits.CPUTime + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,39 @@
+package asy
+
+import (
+    "syscall"
+    "testing"
+)
+
+func TestExceeded(t *testing.T) {
+    limits := DefaultLimits
+    exited := syscall.WaitStatus(1 << 8)
+    aborted := syscall.WaitStatus(syscall.SIGABRT)
+    scanner := func(stream, output string) *limitScanner {
+        s := newLimitScanner()
+        // split between reads
+        s.scan(stream, []byte(output[:len(output)/2]))
+        s.scan(stream, []byte(output[len(output)/2:]))
+        return s
+    }
+    for _, c := range []struct {
+        name   string
+        status syscall.WaitStatus
+        output *limitScanner
+        limit  bool
+    }{
+        {"printed", exited, scanner("stderr", "Out of memory"), false},
+        {"aborted", aborted, scanner("stderr", "GC Warning: Out of memory"),
+            true},
+        {"aborted without a message", aborted, newLimitScanner(), false},
+        {"open files", aborted, scanner("stderr", "Too many open files"),
+            true},
+        {"cpu", syscall.WaitStatus(syscall.SIGXCPU), newLimitScanner(),
+            true},
+    } {
+        err := limits.exceeded(c.status, c.output)
+        if (err != nil) != c.limit {
+            t.Errorf("%s: %v", c.name, err)
+        }
+    }
+}
@@ -0,0 +1,67 @@
+package asy
+
+import (
+    "errors"
+    "time"
+
+    "golang.org/x/sys/unix"
+)
+
+// processTree is Asymptote together with its descendants
+// (latex, dvisvgm, gs, …), to be killed all at once.
+type processTree interface {
+    // kill kills all processes
+    kill() error
+    // reap kills all processes and waits until they are gone
+    reap() error
+}
+
+// processGroup is a processTree without cgroups.
+// Asymptote is started as a leader of a new session, so that its
+// descendants share its process group (unless they leave it).
+type processGroup struct {
+    pid int
+}
+
+func (pg processGroup) kill() error {
+    return killGroup(pg.pid)
+}
+
+func (pg processGroup) reap() error {
+    return reapGroup(pg.pid)
+}
+
+// killGroup kills all processes of the process group led by pid.
+func killGroup(pid int) error {
+    err := unix.Kill(-pid, unix.SIGKILL)
+    if errors.Is(err, unix.ESRCH) {
+        return nil
+    }
+    return err
+}
+
+// reapGroup kills the process group led by (already dead) pid,
+// and waits until all its processes are gone.
+// Leftover descendants would otherwise keep the output pipes open.
+func reapGroup(pid int) error {
+    const (
+        pollEvery   time.Duration = 10e6 // 10ms
+        giveUpAfter time.Duration = 1e9  // 1s
+    )
+    deadline := time.Now().Add(giveUpAfter)
+    for {
+        // processes that were killed but not yet reaped by init
+        // still belong to the group
+        err := unix.Kill(-pid, unix.SIGKILL)
+        if errors.Is(err, unix.ESRCH) {
+            return nil
+        }
+        if err != nil {
+            return err
+        }
+        if time.Now().After(deadline) {
+            return errors.New("process group did not terminate")
+        }
+        time.Sleep(pollEvery)
+    }
+}
@@ -10,26 +10,25 @@ import (
     "asyonline/server/server/reply"
 )
 
-func runReader(dest func([]byte) error, abort func() error,
+func runReader(dest func([]byte) error, abort func() error, maxSize int,
 ) (*os.File, <-chan error, error) {
     streamRead, stream, err := os.Pipe()
     if err != nil {
         return nil, nil, err
     }
     done := make(chan error, 5)
-    go readLoop(streamRead, dest, abort, done)
+    go readLoop(streamRead, dest, abort, maxSize, done)
     return stream, done, nil
 }
 
 func readLoop(stream *os.File,
-    dest func([]byte) error, abort func() error,
+    dest func([]byte) error, abort func() error, maxSize int,
     done chan<- error,
 ) {
     defer close(done)
     defer stream.Close()
     const (
         bufSize               = 1 << 12
-        maxSize               = 1 << 19
         groupBy time.Duration = 20e6 // 20ms
     )
     var (
@@ -0,0 +1,112 @@
+package asy
+
+import (
+    "encoding/binary"
+    "errors"
+    "os"
+    "syscall"
+)
+
+// Runner starts Asymptote processes.
+type Runner interface {
+    // Start starts Asymptote with arguments argv (argv[0] is the name
+    // of the program). The process must not run user code until Resume
+    // is called; attr.Sys is prepared by the task and may be amended.
+    Start(argv []string, attr *os.ProcAttr) (Process, error)
+}
+
+// Process is a started Asymptote process.
+type Process interface {
+    // Pid identifies the process for signals;
+    // the process must lead its process group.
+    Pid() int
+    // Resume applies limits to the process, and allows it to run.
+    Resume(limits *Limits) error
+    Signal(sig os.Signal) error
+    // Wait waits for the process to exit and returns status of Asymptote.
+    Wait() (syscall.WaitStatus, error)
+}
+
+// DirectRunner runs Asymptote as a child of the server, with the same
+// user, network access and filesystem view.
+//
+// The server binary itself is executed first, and holds until it is
+// resumed; then it sets limits on itself and executes Asymptote in the
+// same process, so main must call InitSandbox before anything else.
+// Limits are not applied from the server, as the Go runtime of the
+// holding process may need more memory than Asymptote is given.
+type DirectRunner struct {
+    // path to the asy executable
+    Path string
+}
+
+// argv[0] of the process that holds before executing Asymptote
+const holdName = "asyonline-hold"
+
+// descriptor of the holding process, after stdin, stdout, stderr;
+// the server writes limits to it to resume
+const holdResumeFD = 3
+
+func (r *DirectRunner) Start(argv []string, attr *os.ProcAttr,
+) (Process, error) {
+    resumeRead, resumeWrite, err := os.Pipe()
+    if err != nil {
+        return nil, err
+    }
+    defer resumeRead.Close()
+    holdArgv := append([]string{holdName, r.Path}, argv...)
+    holdAttr := *attr
+    holdAttr.Files = append(attr.Files[:3:3], resumeRead)
+    proc, err := os.StartProcess("/proc/self/exe", holdArgv, &holdAttr)
+    if err != nil {
+        resumeWrite.Close()
+        return nil, err
+    }
+    return &directProcess{proc, resumeWrite}, nil
+}
+
+type directProcess struct {
+    *os.Process
+    resume *os.File
+}
+
+func (p *directProcess) Pid() int {
+    return p.Process.Pid
+}
+
+func (p *directProcess) Resume(limits *Limits) error {
+    err := binary.Write(p.resume, binary.LittleEndian, limits)
+    if errx := p.resume.Close(); err == nil {
+        err = errx
+    }
+    return err
+}
+
+func (p *directProcess) Wait() (syscall.WaitStatus, error) {
+    // closing without a write makes the holding process exit
+    p.resume.Close()
+    state, err := p.Process.Wait()
+    if err != nil {
+        return 0, err
+    }
+    return state.Sys().(syscall.WaitStatus), nil
+}
+
+// holdInit waits until the process is resumed, sets limits and
+// executes path
+func holdInit(args []string) error {
+    if len(args) < 2 {
+        return errors.New("not enough arguments")
+    }
+    path, argv := args[0], args[1:]
+    var limits Limits
+    resume := os.NewFile(holdResumeFD, "resume")
+    if err := binary.Read(resume, binary.LittleEndian, &limits); err != nil {
+        return errors.New("not resumed")
+    }
+    resume.Close()
+    if err := limits.set(); err != nil {
+        return err
+    }
+    return syscall.Exec(path, argv, os.Environ())
+}
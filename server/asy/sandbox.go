@@ -0,0 +1,371 @@
+package asy
+
+import (
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "os/signal"
+    "path/filepath"
+    "strconv"
+    "strings"
+    "syscall"
+
+    "golang.org/x/sys/unix"
+)
+
+// NamespaceRunner runs Asymptote in new user, mount, network, PID, IPC
+// and UTS namespaces. The process sees the working directory (read-write)
+// as its root, the listed host directories (read-only), a private /tmp
+// and /proc, and a few devices; it has no network.
+//
+// The server binary itself is executed as the init process of the sandbox,
+// so main must call InitSandbox before anything else. Like with
+// DirectRunner, Asymptote is executed by a holding process that sets
+// limits on itself; the init process is not limited.
+type NamespaceRunner struct {
+    // path to the asy executable (inside the sandbox)
+    Path string
+    // host directories that are bind-mounted read-only at the same paths,
+    // like "/usr" or "/etc"; missing ones are skipped
+    ReadOnly []string
+}
+
+var DefaultReadOnly = []string{
+    "/bin", "/etc", "/lib", "/lib64", "/usr", "/var/lib/texmf",
+}
+
+// argv[0] of the sandbox init process
+const sandboxInitName = "asyonline-sandbox-init"
+
+// descriptors of the sandbox init process, after stdin, stdout, stderr
+const (
+    sandboxResumeFD = 3 // the server writes limits to it to resume
+    sandboxStatusFD = 4 // receives wait status of Asymptote
+)
+
+func (r *NamespaceRunner) Start(argv []string, attr *os.ProcAttr,
+) (Process, error) {
+    resumeRead, resumeWrite, err := os.Pipe()
+    if err != nil {
+        return nil, err
+    }
+    defer resumeRead.Close()
+    statusRead, statusWrite, err := os.Pipe()
+    if err != nil {
+        resumeWrite.Close()
+        return nil, err
+    }
+    defer statusWrite.Close()
+
+    initArgv := []string{
+        sandboxInitName,
+        strings.Join(r.ReadOnly, string(filepath.ListSeparator)),
+        r.Path,
+    }
+    initArgv = append(initArgv, argv...)
+    var sys syscall.SysProcAttr
+    if attr.Sys != nil {
+        sys = *attr.Sys
+    }
+    sys.Cloneflags |= unix.CLONE_NEWUSER | unix.CLONE_NEWNS |
+        unix.CLONE_NEWNET | unix.CLONE_NEWPID |
+        unix.CLONE_NEWIPC | unix.CLONE_NEWUTS
+    // same user inside, so that the process has no capabilities
+    // after the exec and owns files in the working directory
+    sys.UidMappings = []syscall.SysProcIDMap{
+        {ContainerID: os.Getuid(), HostID: os.Getuid(), Size: 1}}
+    sys.GidMappings = []syscall.SysProcIDMap{
+        {ContainerID: os.Getgid(), HostID: os.Getgid(), Size: 1}}
+    sys.GidMappingsEnableSetgroups = false
+    initAttr := os.ProcAttr{
+        Dir:   attr.Dir,
+        Env:   []string{"PATH=/usr/local/bin:/usr/bin:/bin"},
+        Files: append(attr.Files[:3:3], resumeRead, statusWrite),
+        Sys:   &sys,
+    }
+    proc, err := os.StartProcess("/proc/self/exe", initArgv, &initAttr)
+    if err != nil {
+        resumeWrite.Close()
+        statusRead.Close()
+        return nil, err
+    }
+    return &namespaceProcess{proc, resumeWrite, statusRead}, nil
+}
+
+type namespaceProcess struct {
+    *os.Process
+    resume *os.File
+    status *os.File
+}
+
+func (p *namespaceProcess) Pid() int {
+    return p.Process.Pid
+}
+
+func (p *namespaceProcess) Resume(limits *Limits) error {
+    // passed on to the holding process of Asymptote, see sandboxInit
+    err := binary.Write(p.resume, binary.LittleEndian, limits)
+    if errx := p.resume.Close(); err == nil {
+        err = errx
+    }
+    return err
+}
+
+func (p *namespaceProcess) Wait() (syscall.WaitStatus, error) {
+    p.resume.Close()
+    defer p.status.Close()
+    state, err := p.Process.Wait()
+    if err != nil {
+        return 0, err
+    }
+    var status uint32
+    if err := binary.Read(p.status, binary.LittleEndian, &status); err != nil {
+        // init was killed before Asymptote exited
+        return state.Sys().(syscall.WaitStatus), nil
+    }
+    return syscall.WaitStatus(status), nil
+}
+
+// InitSandbox runs the sandbox init process, or the holding process of
+// DirectRunner, if the program was started as one, and does nothing
+// otherwise.
+func InitSandbox() {
+    if len(os.Args) == 0 {
+        return
+    }
+    var err error
+    switch os.Args[0] {
+    case sandboxInitName:
+        err = sandboxInit(os.Args[1:])
+    case holdName:
+        err = holdInit(os.Args[1:])
+    default:
+        return
+    }
+    fmt.Fprintln(os.Stderr, "sandbox:", err)
+    os.Exit(126)
+}
+
+func sandboxInit(args []string) error {
+    if len(args) < 3 {
+        return errors.New("not enough arguments")
+    }
+    readOnly := filepath.SplitList(args[0])
+    path, argv := args[1], args[2:]
+
+    // the holding process is this binary, which is not in the sandbox,
+    // see startHold; it is opened while the descriptors of init are
+    // open, so that its descriptor is not among those of the holding
+    // process
+    exe, err := os.Open("/proc/self/exe")
+    if err != nil {
+        return err
+    }
+    defer exe.Close()
+
+    // wait until the limits come
+    var limits Limits
+    resume := os.NewFile(sandboxResumeFD, "resume")
+    if err := binary.Read(resume, binary.LittleEndian, &limits); err != nil {
+        return errors.New("not resumed")
+    }
+    resume.Close()
+
+    root, err := os.Getwd()
+    if err != nil {
+        return err
+    }
+    if err := sandboxMount(root, readOnly); err != nil {
+        return err
+    }
+
+    proc, err := startHold(exe, path, argv, &limits)
+    if err != nil {
+        return err
+    }
+    // output pipes must only be held by Asymptote and its descendants
+    if devnull, err := os.OpenFile(os.DevNull, os.O_RDWR, 0); err == nil {
+        for fd := 0; fd < 3; fd++ {
+            unix.Dup2(int(devnull.Fd()), fd)
+        }
+        devnull.Close()
+    }
+
+    // being PID 1 we must forward signals and reap orphans
+    signals := make(chan os.Signal, 4)
+    signal.Notify(signals, unix.SIGPIPE, unix.SIGTERM, unix.SIGINT)
+    go func() {
+        for sig := range signals {
+            proc.Signal(sig)
+        }
+    }()
+    for {
+        var status unix.WaitStatus
+        pid, err := unix.Wait4(-1, &status, 0, nil)
+        if err == unix.EINTR {
+            continue
+        }
+        if err != nil {
+            return err
+        }
+        if pid != proc.Pid {
+            continue
+        }
+        statusFile := os.NewFile(sandboxStatusFD, "status")
+        binary.Write(statusFile, binary.LittleEndian, uint32(status))
+        statusFile.Close()
+        // the rest of processes are killed when init exits
+        switch {
+        case status.Exited():
+            os.Exit(status.ExitStatus())
+        default:
+            os.Exit(128 + int(status.Signal()))
+        }
+    }
+}
+
+// startHold starts the holding process of DirectRunner from the binary
+// exe, and resumes it with limits, so that it executes path in place.
+// The binary is executed by its descriptor, which is resolved before
+// the descriptor is closed on exec.
+func startHold(exe *os.File, path string, argv []string, limits *Limits,
+) (*os.Process, error) {
+    resumeRead, resumeWrite, err := os.Pipe()
+    if err != nil {
+        return nil, err
+    }
+    defer resumeWrite.Close()
+    holdArgv := append([]string{holdName, path}, argv...)
+    proc, err := os.StartProcess(
+        "/proc/self/fd/"+strconv.Itoa(int(exe.Fd())), holdArgv,
+        &os.ProcAttr{
+            Dir: "/",
+            Env: []string{
+                "PATH=/usr/local/bin:/usr/bin:/bin",
+                "HOME=/tmp",
+                "TMPDIR=/tmp",
+            },
+            Files: []*os.File{os.Stdin, os.Stdout, os.Stderr, resumeRead},
+        })
+    resumeRead.Close()
+    if err != nil {
+        return nil, err
+    }
+    err = binary.Write(resumeWrite, binary.LittleEndian, limits)
+    if err != nil {
+        proc.Kill()
+        proc.Wait()
+        return nil, err
+    }
+    return proc, nil
+}
+
+// sandboxMount makes root the root directory of the mount namespace,
+// with read-only directories, devices, /proc and /tmp mounted in it
+func sandboxMount(root string, readOnly []string) error {
+    if err := unix.Mount("", "/", "",
+        unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+        return fmt.Errorf("make / private: %w", err)
+    }
+    if err := unix.Mount(root, root, "",
+        unix.MS_BIND|unix.MS_REC, ""); err != nil {
+        return fmt.Errorf("bind %s: %w", root, err)
+    }
+    for _, dir := range readOnly {
+        if err := sandboxBindReadOnly(root, dir); err != nil {
+            return err
+        }
+    }
+    for _, dev := range []string{"null", "zero", "full", "random", "urandom"} {
+        source := "/dev/" + dev
+        target := filepath.Join(root, source)
+        if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+            return err
+        }
+        if err := ioutil.WriteFile(target, nil, 0o644); err != nil {
+            return err
+        }
+        if err := unix.Mount(source, target, "",
+            unix.MS_BIND, ""); err != nil {
+            return fmt.Errorf("bind %s: %w", source, err)
+        }
+    }
+    for _, dir := range []string{"proc", "tmp", ".oldroot"} {
+        if err := os.MkdirAll(filepath.Join(root, dir), 0o755); err != nil {
+            return err
+        }
+    }
+    if err := unix.Mount("proc", filepath.Join(root, "proc"), "proc",
+        unix.MS_NOSUID|unix.MS_NODEV|unix.MS_NOEXEC, ""); err != nil {
+        return fmt.Errorf("mount /proc: %w", err)
+    }
+    if err := unix.Mount("tmpfs", filepath.Join(root, "tmp"), "tmpfs",
+        unix.MS_NOSUID|unix.MS_NODEV, "size=64m"); err != nil {
+        return fmt.Errorf("mount /tmp: %w", err)
+    }
+    oldroot := filepath.Join(root, ".oldroot")
+    if err := unix.PivotRoot(root, oldroot); err != nil {
+        return fmt.Errorf("pivot_root: %w", err)
+    }
+    if err := unix.Chdir("/"); err != nil {
+        return err
+    }
+    if err := unix.Unmount("/.oldroot", unix.MNT_DETACH); err != nil {
+        return fmt.Errorf("unmount old root: %w", err)
+    }
+    return os.Remove("/.oldroot")
+}
+
+func sandboxBindReadOnly(root, dir string) error {
+    info, err := os.Lstat(dir)
+    if os.IsNotExist(err) {
+        return nil
+    }
+    if err != nil {
+        return err
+    }
+    target := filepath.Join(root, dir)
+    if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+        return err
+    }
+    if info.Mode()&os.ModeSymlink != 0 {
+        // like /lib -> usr/lib
+        link, err := os.Readlink(dir)
+        if err != nil {
+            return err
+        }
+        return os.Symlink(link, target)
+    }
+    if err := os.Mkdir(target, 0o755); err != nil {
+        return err
+    }
+    if err := unix.Mount(dir, target, "",
+        unix.MS_BIND|unix.MS_REC, ""); err != nil {
+        return fmt.Errorf("bind %s: %w", dir, err)
+    }
+    // flags inherited from the host mount are locked
+    // and must be kept when remounting
+    var stat unix.Statfs_t
+    if err := unix.Statfs(target, &stat); err != nil {
+        return err
+    }
+    flags := uintptr(unix.MS_REMOUNT | unix.MS_BIND | unix.MS_RDONLY)
+    for _, f := range [...]struct{ st, ms int64 }{
+        {unix.ST_NOSUID, unix.MS_NOSUID},
+        {unix.ST_NODEV, unix.MS_NODEV},
+        {unix.ST_NOEXEC, unix.MS_NOEXEC},
+        {unix.ST_NOATIME, unix.MS_NOATIME},
+        {unix.ST_NODIRATIME, unix.MS_NODIRATIME},
+        {unix.ST_RELATIME, unix.MS_RELATIME},
+    } {
+        if stat.Flags&f.st != 0 {
+            flags |= uintptr(f.ms)
+        }
+    }
+    if err := unix.Mount("", target, "", flags, ""); err != nil {
+        return fmt.Errorf("remount %s read-only: %w", dir, err)
+    }
+    return nil
+}
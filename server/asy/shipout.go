@@ -0,0 +1,97 @@
+package asy
+
+import (
+    "io/ioutil"
+    "os"
+    "path/filepath"
+    "strings"
+    "time"
+)
+
+// shipoutWatcher finds images that were shipped out by an interactive
+// Asymptote session, by polling the working directory.
+type shipoutWatcher struct {
+    dir    string
+    format string
+    send   func(contents []byte) error
+    // modification state of already seen files
+    seen map[string]shipoutState
+}
+
+type shipoutState = struct {
+    modTime time.Time
+    size    int64
+    sent    bool
+}
+
+func newShipoutWatcher(dir, format string, send func([]byte) error,
+) *shipoutWatcher {
+    return &shipoutWatcher{
+        dir:    dir,
+        format: format,
+        send:   send,
+        seen:   make(map[string]shipoutState),
+    }
+}
+
+// loop sends images until stop is closed, then sends the remaining ones
+func (w *shipoutWatcher) loop(stop <-chan void, done chan<- error) {
+    defer close(done)
+    const pollEvery time.Duration = 250e6 // 250ms
+    ticker := time.NewTicker(pollEvery)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+            if err := w.scan(false); err != nil {
+                done <- err
+                return
+            }
+        case <-stop:
+            if err := w.scan(true); err != nil {
+                done <- err
+            }
+            return
+        }
+    }
+}
+
+// scan sends images that have changed since the last scan.
+// Unless final is set, images are sent only after they stop changing
+// for a whole poll period, so that partially written files are skipped.
+func (w *shipoutWatcher) scan(final bool) error {
+    entries, err := ioutil.ReadDir(w.dir)
+    if err != nil {
+        return err
+    }
+    for _, entry := range entries {
+        name := entry.Name()
+        if !entry.Mode().IsRegular() ||
+            !strings.HasSuffix(name, "."+w.format) {
+            continue
+        }
+        state, ok := w.seen[name]
+        changed := !ok ||
+            !entry.ModTime().Equal(state.modTime) ||
+            entry.Size() != state.size
+        if changed {
+            state = shipoutState{entry.ModTime(), entry.Size(), false}
+        }
+        if !state.sent && (!changed || final) {
+            contents, err := ioutil.ReadFile(filepath.Join(w.dir, name))
+            if err != nil {
+                if os.IsNotExist(err) {
+                    delete(w.seen, name)
+                    continue
+                }
+                return err
+            }
+            if err := w.send(contents); err != nil {
+                return err
+            }
+            state.sent = true
+        }
+        w.seen[name] = state
+    }
+    return nil
+}
@@ -8,17 +8,18 @@ import (
     "os"
     "path/filepath"
     "strings"
+    "syscall"
     "time"
 
     "golang.org/x/sys/unix"
 
     "asyonline/server/common/stopper"
     "asyonline/server/server/reply"
+    "asyonline/server/server/results"
 )
 
 type void = struct{}
 
-const maxDuration float64 = 30
 const nanosecond = 1e-9
 
 type conn interface {
@@ -31,6 +32,7 @@ type conn interface {
 
 type Task struct {
     stopper.Stopper
+    config      *Config
     conn        conn
     workdir     string
     timer       *timer
@@ -38,19 +40,27 @@ type Task struct {
     stderrRedir bool
     verbosity   int
     started     bool
+    interactive bool
+    // source files, kept for the key of results
+    sources map[string][]byte
+    // stdin of interactive process
+    stdinRead  *os.File
+    stdinWrite *os.File
 }
 
-func NewTask(conn conn) (*Task, error) {
+func NewTask(conn conn, config *Config) (*Task, error) {
     task := &Task{
+        config:      config,
         conn:        conn,
         Stopper:     stopper.New(),
-        format:      "svg",
+        format:      config.Formats[0],
         stderrRedir: true,
         verbosity:   0,
+        sources:     make(map[string][]byte),
     }
     task.timer = newTimer(task.Stopped)
     var err error
-    task.workdir, err = tempDir(task.Stopped)
+    task.workdir, err = tempDir(config.TempDir, task.Stopped)
     if err != nil {
         log.Print(err)
         return nil, err
@@ -58,9 +68,32 @@ func NewTask(conn conn) (*Task, error) {
     return task, nil
 }
 
-func tempDir(stopped <-chan void) (string, error) {
+// NewInteractiveTask creates a task that runs an Asymptote shell.
+// Its input is passed with WriteStdin, and every image shipped out
+// is sent as a result.
+func NewInteractiveTask(conn conn, config *Config) (*Task, error) {
+    task, err := NewTask(conn, config)
+    if err != nil {
+        return nil, err
+    }
+    task.interactive = true
+    task.stdinRead, task.stdinWrite, err = os.Pipe()
+    if err != nil {
+        log.Print(err)
+        task.Stop()
+        return nil, err
+    }
+    go func(stdinRead, stdinWrite *os.File, stopped <-chan void) {
+        <-stopped
+        stdinRead.Close()
+        stdinWrite.Close()
+    }(task.stdinRead, task.stdinWrite, task.Stopped)
+    return task, nil
+}
+
+func tempDir(dir string, stopped <-chan void) (string, error) {
     var workdir string
-    workdir, err := ioutil.TempDir("/tmp", "tmp*")
+    workdir, err := ioutil.TempDir(dir, "tmp*")
     if err != nil {
         log.Print(err)
         return workdir, err
@@ -89,6 +122,9 @@ func (task *Task) AddFile(filename string, contents []byte) error {
         log.Print(err)
         return err
     }
+    if task.config.Results != nil {
+        task.sources[filename] = contents
+    }
     return nil
 }
 
@@ -108,6 +144,9 @@ func checkFilename(filename string) error {
 }
 
 func (task *Task) SetDuration(duration float64) error {
+    if task.interactive {
+        return reply.Error("'duration' cannot be set in interactive mode")
+    }
     if duration < 0 {
         return reply.Error("'duration' must be nonnegative")
     }
@@ -119,14 +158,13 @@ func (task *Task) SetFormat(format string) error {
     if task.started {
         return reply.Error("The task has already started, cannot set options")
     }
-    switch format {
-    case "svg", "pdf", "png":
-    default:
-        return reply.Error(
-            "'format' can only be \"svg\", \"pdf\", or \"png\"")
+    for _, allowed := range task.config.Formats {
+        if format == allowed {
+            task.format = format
+            return nil
+        }
     }
-    task.format = format
-    return nil
+    return reply.Error("'format' can only be " + quoteList(task.config.Formats))
 }
 
 func (task *Task) SetStderrRedir(stderrRedir bool) error {
@@ -151,28 +189,85 @@ func (task *Task) SetVerbosity(verbosity int) error {
     return nil
 }
 
+// WriteStdin passes input to the interactive process.
+// Input written before the start is passed when the process starts.
+func (task *Task) WriteStdin(input []byte) error {
+    if !task.interactive {
+        return reply.Error("'stdin' is only available in interactive mode")
+    }
+    select {
+    case <-task.Stopped:
+        return nil
+    default:
+    }
+    if _, err := task.stdinWrite.Write(input); err != nil {
+        select {
+        case <-task.Stopped:
+            return nil
+        default:
+        }
+        if errors.Is(err, unix.EPIPE) {
+            return reply.Error("The process does not accept input")
+        }
+        return err
+    }
+    return nil
+}
+
 func (task *Task) Start(mainname string) error {
     if task.started {
         return reply.Error("The task has already started, cannot start again")
     }
+    if task.interactive {
+        // mainname is ignored
+        task.timer.setDuration(
+            time.Duration(task.config.MaxInteractiveDuration / nanosecond))
+        task.started = true
+        go task.runLoop("")
+        return nil
+    }
     if err := checkFilename(mainname); err != nil {
         return err
     }
-    task.timer.setDuration(time.Duration(maxDuration / nanosecond))
+    task.timer.setDuration(time.Duration(task.config.MaxDuration / nanosecond))
     task.started = true
+    if store := task.config.Results; store != nil {
+        key := store.Key(task.sources, mainname,
+            task.format, task.verbosity, task.stderrRedir)
+        if outcome, ok := store.Load(key); ok {
+            go task.replay(outcome)
+            return nil
+        }
+        task.conn = results.NewRecorder(task.conn, store, key)
+    }
     go task.runLoop(mainname)
     return nil
 }
 
+// replay sends the outcome of an identical task instead of running asy
+func (task *Task) replay(outcome *results.Outcome) {
+    defer task.Stop()
+    if err := outcome.Replay(task.conn); err != nil {
+        log.Print(err)
+    }
+}
+
 func (task *Task) runLoop(mainname string) {
     defer task.Stop()
-    outname := filepath.Join(task.workdir, "output."+task.format)
+    // relative to the working directory, which may look different
+    // from inside of a sandbox
+    outbase := "output." + task.format
+    outname := filepath.Join(task.workdir, outbase)
     asyArgs := []string{
         "asy",
         "-offscreen",
         "-outformat", task.format,
-        mainname,
-        "-outname", outname,
+    }
+    if task.interactive {
+        // read commands from stdin even though it is not a terminal
+        asyArgs = append(asyArgs, "-inpipe", "0")
+    } else {
+        asyArgs = append(asyArgs, mainname, "-outname", outbase)
     }
     switch task.verbosity {
     case 0:
@@ -186,7 +281,8 @@ func (task *Task) runLoop(mainname string) {
         return
     }
 
-    var asyProc *os.Process
+    var asyProc Process
+    var asyTree processTree
     var asyProcStarted = make(chan void)
     sigpipe := func() error {
         select {
@@ -199,6 +295,27 @@ func (task *Task) runLoop(mainname string) {
     var asyProcAttr = os.ProcAttr{
         Dir:   task.workdir,
         Files: make([]*os.File, 0, 3),
+        Sys:   &syscall.SysProcAttr{Setsid: true},
+    }
+    var asyCgroup *cgroup
+    if task.config.Cgroup.Parent != "" {
+        var err error
+        asyCgroup, err = newCgroup(
+            &task.config.Cgroup, filepath.Base(task.workdir))
+        if err != nil {
+            errx := task.conn.Complete(err)
+            if errx != nil {
+                log.Print(errx)
+            }
+            return
+        }
+        defer func() {
+            if err := asyCgroup.remove(); err != nil {
+                log.Print(err)
+            }
+        }()
+        asyProcAttr.Sys.UseCgroupFD = true
+        asyProcAttr.Sys.CgroupFD = int(asyCgroup.dir.Fd())
     }
 
     var loose_files = make([]*os.File, 0, 2)
@@ -211,7 +328,10 @@ func (task *Task) runLoop(mainname string) {
         loose_files = loose_files[len(loose_files):]
     }
     defer close_loose_files()
-    {
+    if task.interactive {
+        loose_files = append(loose_files, task.stdinRead)
+        asyProcAttr.Files = append(asyProcAttr.Files, task.stdinRead)
+    } else {
         var stdin *os.File
         stdin, err := os.Open(os.DevNull)
         if err != nil {
@@ -222,13 +342,18 @@ func (task *Task) runLoop(mainname string) {
     }
     var stdoutDone <-chan error
     var stderrDone <-chan error
+    var limitOutput = newLimitScanner()
     {
         var stdout *os.File
         var err error
         stdout, stdoutDone, err = runReader(
             func(output []byte) error {
+                // error output goes to stdout when redirected
+                if task.stderrRedir {
+                    limitOutput.scan("stdout", output)
+                }
                 return task.conn.SendOutput("stdout", output)
-            }, sigpipe)
+            }, sigpipe, task.config.MaxOutput)
         if err != nil {
             errx := task.conn.Complete(err)
             if errx != nil {
@@ -247,8 +372,9 @@ func (task *Task) runLoop(mainname string) {
         var err error
         stderr, stderrDone, err = runReader(
             func(output []byte) error {
+                limitOutput.scan("stderr", output)
                 return task.conn.SendOutput("stderr", output)
-            }, sigpipe)
+            }, sigpipe, task.config.MaxOutput)
         if err != nil {
             errx := task.conn.Complete(err)
             if errx != nil {
@@ -260,9 +386,14 @@ func (task *Task) runLoop(mainname string) {
         asyProcAttr.Files = append(asyProcAttr.Files, stderr)
     }
 
+    // empty output indicates the start of the process
+    if err := task.conn.SendOutput("stdout", nil); err != nil {
+        log.Print(err)
+        return
+    }
     {
         var err error
-        asyProc, err = os.StartProcess("/usr/bin/asy", asyArgs, &asyProcAttr)
+        asyProc, err = task.config.Runner.Start(asyArgs, &asyProcAttr)
         if err != nil {
             errx := task.conn.Complete(err)
             if errx != nil {
@@ -270,10 +401,41 @@ func (task *Task) runLoop(mainname string) {
             }
             return
         }
+        if asyCgroup != nil {
+            asyTree = asyCgroup
+        } else {
+            asyTree = processGroup{asyProc.Pid()}
+        }
+        err = asyProc.Resume(&task.config.Limits)
+        if err != nil {
+            if err := asyTree.kill(); err != nil {
+                log.Print(err)
+            }
+            asyProc.Wait()
+            if err := asyTree.reap(); err != nil {
+                log.Print(err)
+            }
+            errx := task.conn.Complete(err)
+            if errx != nil {
+                log.Print(errx)
+            }
+            return
+        }
     }
     close(asyProcStarted)
     close(task.timer.start)
     close_loose_files()
+    var shipoutStop = make(chan void)
+    var shipoutDone = make(chan error, 1)
+    if task.interactive {
+        watcher := newShipoutWatcher(task.workdir, task.format,
+            func(contents []byte) error {
+                return task.conn.SendResult(task.format, contents)
+            })
+        go watcher.loop(shipoutStop, shipoutDone)
+    } else {
+        close(shipoutDone)
+    }
     var (
         dead   chan<- void
         killed <-chan error
@@ -286,7 +448,7 @@ func (task *Task) runLoop(mainname string) {
         )
         dead = deadRS
         killed = killedRS
-        go killLoop(asyProc, (chan<- error)(killedRS),
+        go killLoop(asyTree, (chan<- error)(killedRS),
             (<-chan error)(killRS), (<-chan void)(deadRS),
         )
         go func(kill chan<- error) {
@@ -312,23 +474,44 @@ func (task *Task) runLoop(mainname string) {
     // • killed by timer → "Process time limit (<float seconds>s)"
     // • wait error      → "Server error"
     // • I/O truncated   → "Process output limit (<integer bytes>B)"
+    // • killed by OOM   → "Process memory limit (<integer bytes>B)"
+    // • killed by limit,
+    //   failed at limit → "Process <…> limit (…)"
     // • nonzero status  → "Execution failed"
     // • other I/O error → "Process I/O error"
     // • no result file  → "No result image"
 
     var asyErr, asyIOErr, asyProcErr error
     {
-        asyState, err := asyProc.Wait()
+        asyStatus, err := asyProc.Wait()
         close(dead)
         reason := <-killed
+        if err := asyTree.reap(); err != nil {
+            log.Print(err)
+        }
         switch {
         case reason != nil:
             asyErr = reason
         case err != nil:
             asyErr = err
         }
-        if !asyState.Success() {
-            asyProcErr = reply.Error("Execution failed")
+        if err == nil && !(asyStatus.Exited() && asyStatus.ExitStatus() == 0) {
+            switch {
+            case asyCgroup != nil && asyCgroup.oomKilled():
+                asyProcErr = reply.Error(fmt.Sprintf(
+                    "Process reached memory limit (%dB)",
+                    task.config.Cgroup.MemoryMax))
+            case asyCgroup != nil && asyCgroup.pidsExceeded():
+                asyProcErr = reply.Error(fmt.Sprintf(
+                    "Process reached process limit (%d)",
+                    task.config.Cgroup.PidsMax))
+            default:
+                asyProcErr = task.config.Limits.exceeded(
+                    asyStatus, limitOutput)
+            }
+            if asyProcErr == nil {
+                asyProcErr = reply.Error("Execution failed")
+            }
         }
     }
 
@@ -352,7 +535,13 @@ func (task *Task) runLoop(mainname string) {
         }
     }
 
-    {
+    close(shipoutStop)
+    if err := <-shipoutDone; err != nil {
+        log.Print(err)
+        return
+    }
+
+    if !task.interactive {
         var result []byte
         var err error
         result, err = ioutil.ReadFile(outname)
@@ -384,7 +573,7 @@ func (task *Task) runLoop(mainname string) {
     }
 }
 
-func killLoop(proc *os.Process, killed chan<- error,
+func killLoop(tree processTree, killed chan<- error,
     kill <-chan error, dead <-chan void,
 ) {
     defer close(killed)
@@ -392,10 +581,25 @@ func killLoop(proc *os.Process, killed chan<- error,
     case <-dead:
         return
     case reason := <-kill:
-        // TODO maybe kill the whole process group, just in case
-        if err := proc.Kill(); err != nil {
+        if err := tree.kill(); err != nil {
             log.Print(err)
         }
         killed <- reason
     }
 }
+
+// quoteList formats ["a", "b", "c"] as `"a", "b", or "c"`
+func quoteList(items []string) string {
+    quoted := make([]string, len(items))
+    for i, item := range items {
+        quoted[i] = "\"" + item + "\""
+    }
+    switch len(quoted) {
+    case 1:
+        return quoted[0]
+    case 2:
+        return quoted[0] + " or " + quoted[1]
+    }
+    return strings.Join(quoted[:len(quoted)-1], ", ") +
+        ", or " + quoted[len(quoted)-1]
+}
@@ -0,0 +1,28 @@
+package asy
+
+import (
+    "bytes"
+    "fmt"
+    "os/exec"
+)
+
+// Version identifies the asy executable at path and the LaTeX on PATH,
+// which outcomes of tasks depend on, by the first lines of their
+// version messages
+func Version(path string) (string, error) {
+    out, err := exec.Command(path, "-version").CombinedOutput()
+    if err != nil {
+        return "", fmt.Errorf("%s -version: %w", path, err)
+    }
+    version := string(firstLine(out))
+    // asy may also run without LaTeX, for labels without TeX
+    if out, err := exec.Command("latex", "-version").Output(); err == nil {
+        version += "; " + string(firstLine(out))
+    }
+    return version, nil
+}
+
+func firstLine(out []byte) []byte {
+    line, _, _ := bytes.Cut(out, []byte("\n"))
+    return bytes.TrimSpace(line)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+    "crypto/subtle"
+    "encoding/json"
+    "log"
+    "net/http"
+    "strings"
+
+    "asyonline/server/queue"
+    "asyonline/server/server/reply"
+)
+
+// adminHandler serves the admin API of the queue:
+//
+//    GET  /admin/backends          list backends
+//    POST /admin/backends/add      {"addr": <address>}
+//    POST /admin/backends/drain    {"addr": <address>}
+//    POST /admin/backends/remove   {"addr": <address>}
+//
+// Requests must carry the header "Authorization: Bearer <token>".
+func adminHandler(q *queue.Queue, token string) http.Handler {
+    mux := http.NewServeMux()
+    mux.HandleFunc("/admin/backends", func(
+        w http.ResponseWriter, req *http.Request,
+    ) {
+        if req.Method != http.MethodGet {
+            adminError(w, http.StatusMethodNotAllowed, "Use GET")
+            return
+        }
+        adminReply(w, q.Backends())
+    })
+    for path, f := range map[string]func(addr string) error{
+        "/admin/backends/add":    q.AddBackend,
+        "/admin/backends/drain":  q.DrainBackend,
+        "/admin/backends/remove": q.RemoveBackend,
+    } {
+        f := f
+        mux.HandleFunc(path, func(w http.ResponseWriter, req *http.Request) {
+            if req.Method != http.MethodPost {
+                adminError(w, http.StatusMethodNotAllowed, "Use POST")
+                return
+            }
+            var args struct {
+                Addr string `json:"addr"`
+            }
+            err := json.NewDecoder(req.Body).Decode(&args)
+            if err != nil {
+                adminError(w, http.StatusBadRequest,
+                    "Arguments are not a correct JSON")
+                return
+            }
+            if err := f(args.Addr); err != nil {
+                if e, ok := err.(reply.Error); ok {
+                    adminError(w, http.StatusBadRequest, e.Error())
+                    return
+                }
+                log.Print(err)
+                adminError(w, http.StatusInternalServerError,
+                    "Server error")
+                return
+            }
+            adminReply(w, q.Backends())
+        })
+    }
+    return requireToken(token, mux)
+}
+
+// requireToken passes requests that carry the header
+// "Authorization: Bearer <token>" to h
+func requireToken(token string, h http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+        auth := req.Header.Get("Authorization")
+        given := strings.TrimPrefix(auth, "Bearer ")
+        if given == auth || subtle.ConstantTimeCompare(
+            []byte(given), []byte(token)) != 1 {
+            w.Header().Set("WWW-Authenticate", "Bearer")
+            adminError(w, http.StatusUnauthorized, "Unauthorized")
+            return
+        }
+        h.ServeHTTP(w, req)
+    })
+}
+
+func adminReply(w http.ResponseWriter, v interface{}) {
+    w.Header().Set("Content-Type", "application/json")
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        log.Print(err)
+    }
+}
+
+func adminError(w http.ResponseWriter, code int, message string) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(code)
+    json.NewEncoder(w).Encode(struct {
+        Error string `json:"error"`
+    }{message})
+}
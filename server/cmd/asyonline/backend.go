@@ -0,0 +1,245 @@
+package main
+
+import (
+    "encoding/json"
+    "flag"
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+    "os/signal"
+    "syscall"
+
+    "golang.org/x/net/websocket"
+
+    "asyonline/server/asy"
+    "asyonline/server/config"
+    "asyonline/server/queue"
+    "asyonline/server/server"
+    "asyonline/server/server/cache"
+    "asyonline/server/server/reply"
+    "asyonline/server/server/results"
+)
+
+func serveBackend(name string, args []string) error {
+    fs := flag.NewFlagSet(name, flag.ExitOnError)
+    cfg, err := config.Load(fs, args, config.BindBackend)
+    if err != nil {
+        return err
+    }
+    if err := cfg.Backend.Validate(); err != nil {
+        return err
+    }
+    b, err := newBackend(&cfg.Backend)
+    if err != nil {
+        return err
+    }
+    mux := http.NewServeMux()
+    mux.Handle("/asy/interactive", b.interactiveHandler())
+    mux.Handle(queue.InfoPath, b.infoHandler())
+    switch {
+    case cfg.Backend.Redis != "":
+        return b.serveWorker(&cfg.Backend, mux)
+    case cfg.Backend.Queue != "":
+        return b.serveUplink(&cfg.Backend, mux)
+    }
+    mux.Handle("/asy", b.handler())
+    return listen(cfg.Backend.Listen, mux)
+}
+
+// serveWorker takes tasks from a Redis queue instead of accepting them
+// at "/asy". On SIGINT or SIGTERM, running tasks are stopped and
+// the backend is unregistered from the queue.
+func (b *backend) serveWorker(cfg *config.Backend, mux *http.ServeMux,
+) error {
+    w := queue.NewWorker(&queue.WorkerConfig{
+        Redis:    cfg.Redis,
+        Addr:     cfg.WorkerAddr(),
+        Capacity: cfg.Capacity,
+        NewTask: func(conn queue.LocalConn) (queue.LocalTask, error) {
+            task, err := asy.NewTask(conn, b.config)
+            if err != nil {
+                return nil, err
+            }
+            return task, nil
+        },
+    })
+    mux.Handle(queue.WorkerPath, w.Handler())
+    b.worker = w
+    return serveUntilSignal(cfg.Listen, mux, w.Run, w.Shutdown)
+}
+
+// serveUplink connects to a queue and takes tasks from it instead of
+// accepting them at "/asy". On SIGINT or SIGTERM, the queue is told
+// that the backend is shutting down, and running tasks are let finish.
+func (b *backend) serveUplink(cfg *config.Backend, mux *http.ServeMux,
+) error {
+    u := queue.NewUplink(&queue.UplinkConfig{
+        URL:      cfg.Queue,
+        Token:    cfg.QueueToken,
+        Capacity: cfg.Capacity,
+        Serve: b.handleWith(func(conn *server.Conn) (*asy.Task, error) {
+            return asy.NewTask(conn, b.config)
+        }),
+    })
+    return serveUntilSignal(cfg.Listen, mux, u.Run, u.Shutdown)
+}
+
+// serveUntilSignal serves mux while run takes tasks. On SIGINT or
+// SIGTERM, shutdown is called, and serveUntilSignal returns when
+// run does.
+func serveUntilSignal(addr string, mux *http.ServeMux,
+    run func() error, shutdown func(),
+) error {
+    listened := make(chan error, 1)
+    go func() { listened <- listen(addr, mux) }()
+    ran := make(chan error, 1)
+    go func() { ran <- run() }()
+    signals := make(chan os.Signal, 1)
+    signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+    select {
+    case err := <-listened:
+        shutdown()
+        <-ran
+        return err
+    case err := <-ran:
+        return err
+    case sig := <-signals:
+        log.Printf("%v, shutting down", sig)
+        shutdown()
+        return <-ran
+    }
+}
+
+// backend runs Asymptote tasks for websocket connections
+type backend struct {
+    config   *asy.Config
+    sources  *cache.Cache
+    capacity int
+    // holds a value for each task that may start
+    gate chan void
+    // takes tasks from a Redis queue instead of the gate, if not nil
+    worker *queue.Worker
+}
+
+func newBackend(cfg *config.Backend) (*backend, error) {
+    gate := make(chan void, cfg.Capacity)
+    for i := 0; i < cfg.Capacity; i++ {
+        gate <- void{}
+    }
+    b := &backend{
+        config:   cfg.AsyConfig(),
+        sources:  cache.New(cfg.Sources.Size, cfg.Sources.TTLDuration()),
+        capacity: cfg.Capacity,
+        gate:     gate,
+    }
+    var err error
+    b.config.Results, err = newResults(&cfg.Results, cfg.Asy)
+    if err != nil {
+        return nil, err
+    }
+    return b, nil
+}
+
+// newResults opens the result cache, or returns nil if it is disabled.
+// Unless it is set, the version is detected from asy at asyPath.
+func newResults(cfg *config.Results, asyPath string) (*results.Store, error) {
+    if cfg.Dir == "" {
+        return nil, nil
+    }
+    version, err := resultsVersion(cfg, asyPath)
+    if err != nil {
+        return nil, err
+    }
+    return results.New(cfg.Dir, cfg.Size, version)
+}
+
+// resultsVersion returns the version of the settings, or detects it
+// from asy at asyPath unless the path is empty
+func resultsVersion(cfg *config.Results, asyPath string) (string, error) {
+    if cfg.Version != "" || asyPath == "" {
+        return cfg.Version, nil
+    }
+    version, err := asy.Version(asyPath)
+    if err != nil {
+        return "", fmt.Errorf("results: %w", err)
+    }
+    return version, nil
+}
+
+// infoHandler reports the capacity and occupancy of the backend,
+// interactive sessions included
+func (b *backend) infoHandler() http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+        busy := b.capacity - len(b.gate)
+        if b.worker != nil {
+            busy += b.worker.Busy()
+        }
+        w.Header().Set("Content-Type", "application/json")
+        err := json.NewEncoder(w).Encode(&queue.BackendInfo{
+            Capacity: b.capacity,
+            Busy:     busy,
+        })
+        if err != nil {
+            log.Print(err)
+        }
+    })
+}
+
+func (b *backend) handler() http.Handler {
+    return websocket.Server{
+        Config: websocket.Config{Protocol: []string{server.ProtocolAsy}},
+        Handshake: server.Handshake(
+            server.ProtocolAsy, server.ProtocolAsyRestore,
+            server.ProtocolJSONAsy, server.ProtocolJSONAsyRestore,
+        ),
+        Handler: b.handleWith(func(conn *server.Conn) (*asy.Task, error) {
+            return asy.NewTask(conn, b.config)
+        }),
+    }
+}
+
+func (b *backend) interactiveHandler() http.Handler {
+    return websocket.Server{
+        Config: websocket.Config{
+            Protocol: []string{server.ProtocolAsyInteractive}},
+        Handshake: server.Handshake(
+            server.ProtocolAsyInteractive,
+            server.ProtocolAsyInteractiveRestore,
+            server.ProtocolJSONAsyInteractive,
+            server.ProtocolJSONAsyInteractiveRestore,
+        ),
+        Handler: b.handleWith(func(conn *server.Conn) (*asy.Task, error) {
+            return asy.NewInteractiveTask(conn, b.config)
+        }),
+    }
+}
+
+func (b *backend) handleWith(
+    newTask func(conn *server.Conn) (*asy.Task, error),
+) websocket.Handler {
+    return websocket.Handler(func(wsconn *websocket.Conn) {
+        conn := server.NewConn(wsconn, b.sources)
+        defer conn.Close()
+        select {
+        case <-b.gate:
+            defer func() { b.gate <- void{} }()
+        default:
+            // a slot frees at the latest when a task hits its time limit,
+            // unless interactive sessions take all of them
+            conn.Deny(reply.Busy{RetryAfter: b.config.MaxDuration})
+            return
+        }
+        task, err := newTask(conn)
+        if err != nil {
+            conn.Deny(err)
+            return
+        }
+        defer task.Stop()
+        conn.HandleWith(task)
+        select {
+        case <-conn.Stopped:
+        case <-task.Stopped:
+        }
+    })
+}
@@ -0,0 +1,73 @@
+// Command asyonline runs the servers of Asymptote Online.
+//
+// Usage:
+//
+//    asyonline serve-backend [flags]   run Asymptote tasks
+//    asyonline serve-queue [flags]     dispatch tasks to backends
+//    asyonline serve [flags]           run both in one process
+//    asyonline serve-scheduler [flags] schedule tasks of a Redis queue
+//
+// Run "asyonline <command> -help" for the flags of a command.
+package main
+
+import (
+    "fmt"
+    "log"
+    "net/http"
+    "os"
+
+    "asyonline/server/asy"
+)
+
+type void = struct{}
+
+type command struct {
+    name    string
+    summary string
+    run     func(name string, args []string) error
+}
+
+var commands = []command{
+    {"serve-backend", "run Asymptote tasks", serveBackend},
+    {"serve-queue", "dispatch tasks to backends", serveQueue},
+    {"serve", "run both in one process", serve},
+    {"serve-scheduler", "schedule tasks of a Redis queue", serveScheduler},
+}
+
+func main() {
+    asy.InitSandbox()
+    if len(os.Args) < 2 {
+        usage()
+        os.Exit(2)
+    }
+    name := os.Args[1]
+    for _, cmd := range commands {
+        if cmd.name != name {
+            continue
+        }
+        err := cmd.run("asyonline "+name, os.Args[2:])
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
+    fmt.Fprintf(os.Stderr, "asyonline: unknown command %q\n", name)
+    usage()
+    os.Exit(2)
+}
+
+func usage() {
+    fmt.Fprintln(os.Stderr, "Usage: asyonline <command> [flags]")
+    fmt.Fprintln(os.Stderr, "Commands:")
+    for _, cmd := range commands {
+        fmt.Fprintf(os.Stderr, "    %-18s%s\n", cmd.name, cmd.summary)
+    }
+}
+
+func listen(addr string, handler http.Handler) error {
+    log.Println("serving on", addr)
+    return (&http.Server{
+        Addr:    addr,
+        Handler: handler,
+    }).ListenAndServe()
+}
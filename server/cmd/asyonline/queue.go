@@ -0,0 +1,175 @@
+package main
+
+import (
+    "errors"
+    "flag"
+    "net/http"
+
+    "golang.org/x/net/websocket"
+
+    "asyonline/server/config"
+    "asyonline/server/queue"
+    "asyonline/server/server"
+    "asyonline/server/server/cache"
+)
+
+func serveQueue(name string, args []string) error {
+    fs := flag.NewFlagSet(name, flag.ExitOnError)
+    cfg, err := config.Load(fs, args, config.BindQueue)
+    if err != nil {
+        return err
+    }
+    if err := cfg.Queue.Validate(); err != nil {
+        return err
+    }
+    if cfg.Queue.Redis != "" && cfg.Queue.AdminToken != "" {
+        return errors.New(
+            "queue: 'adminToken' cannot be set with 'redis', " +
+                "backends register in Redis")
+    }
+    if cfg.Queue.Redis != "" && cfg.Queue.WorkerToken != "" {
+        return errors.New(
+            "queue: 'workerToken' cannot be set with 'redis'")
+    }
+    if cfg.Queue.Results.Dir != "" && cfg.Queue.Results.Version == "" {
+        return errors.New("queue: 'version' of results must be set")
+    }
+    if len(cfg.Queue.Backends) == 0 && cfg.Queue.AdminToken == "" &&
+        cfg.Queue.WorkerToken == "" && cfg.Queue.Redis == "" {
+        return errors.New("queue: 'backends' must not be empty " +
+            "without 'adminToken' or 'workerToken'")
+    }
+    queueConfig := cfg.Queue.QueueConfig()
+    queueConfig.Results, err = newResults(&cfg.Queue.Results, "")
+    if err != nil {
+        return err
+    }
+    q := queue.NewQueue(queueConfig)
+    mux := http.NewServeMux()
+    mux.Handle("/asy", queueHandler(q, &cfg.Queue))
+    mux.Handle("/asy/compile", compileHandler(q))
+    handleRender(mux, q, &cfg.Queue, cfg.Queue.Results.Version)
+    if cfg.Queue.Jobs.Dir != "" {
+        if err := handleJobs(mux, q, &cfg.Queue.Jobs); err != nil {
+            return err
+        }
+    }
+    if cfg.Queue.AdminToken != "" {
+        mux.Handle("/admin/", adminHandler(q, cfg.Queue.AdminToken))
+    }
+    if cfg.Queue.WorkerToken != "" {
+        handleWorkers(mux, q, cfg.Queue.WorkerToken)
+    }
+    return listen(cfg.Queue.Listen, mux)
+}
+
+// handleWorkers accepts backends that connect to the queue,
+// see queue.Uplink
+func handleWorkers(mux *http.ServeMux, q *queue.Queue, token string) {
+    h := requireToken(token, q.WorkerHandler())
+    mux.Handle(queue.UplinkPath, h)
+    mux.Handle(queue.UplinkPath+"/", h)
+}
+
+func queueHandler(q *queue.Queue, cfg *config.Queue) http.Handler {
+    sources := cache.New(cfg.Sources.Size, cfg.Sources.TTLDuration())
+    return websocket.Server{
+        Config: websocket.Config{Protocol: []string{server.ProtocolAsy}},
+        Handshake: server.Handshake(
+            server.ProtocolAsy, server.ProtocolAsyRestore,
+            server.ProtocolJSONAsy, server.ProtocolJSONAsyRestore,
+        ),
+        Handler: websocket.Handler(func(wsconn *websocket.Conn) {
+            conn := server.NewConn(wsconn, sources)
+            defer conn.Close()
+            task, err := q.NewTask(conn)
+            if err != nil {
+                conn.Deny(err)
+                return
+            }
+            defer task.Stop()
+            conn.HandleWith(task)
+            select {
+            case <-conn.Stopped:
+            case <-task.Stopped:
+            }
+        }),
+    }
+}
+
+// compileHandler runs tasks of the queue for POST requests,
+// see server.Compilation
+func compileHandler(q *queue.Queue) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        c := server.NewCompilation(w, r)
+        defer c.Close()
+        task, err := q.NewTask(c)
+        if err != nil {
+            c.Deny(err)
+            return
+        }
+        defer task.Stop()
+        c.HandleWith(task)
+        select {
+        case <-c.Stopped:
+        case <-task.Stopped:
+        }
+    })
+}
+
+// handleRender serves images of snippets at server.RenderPath, keeping
+// them under version, see server.Rendering
+func handleRender(mux *http.ServeMux, q *queue.Queue, cfg *config.Queue,
+    version string,
+) {
+    images := cache.New(cfg.Render.Size, cfg.Render.TTLDuration())
+    h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        c := server.NewRendering(w, r, images, version)
+        defer c.Close()
+        select {
+        case <-c.Stopped:
+            // denied, or the image is known
+            return
+        default:
+        }
+        task, err := q.NewTask(c)
+        if err != nil {
+            c.Deny(err)
+            return
+        }
+        defer task.Stop()
+        c.HandleWith(task)
+        select {
+        case <-c.Stopped:
+        case <-task.Stopped:
+        }
+    })
+    for _, format := range []string{"svg", "png", "pdf"} {
+        mux.Handle(server.RenderPath+"."+format, h)
+    }
+}
+
+// handleJobs serves the job API, running jobs with tasks of the queue,
+// see server.Jobs
+func handleJobs(mux *http.ServeMux, q *queue.Queue, cfg *config.Jobs) error {
+    jobs, err := server.NewJobs(cfg.Dir, cfg.TTLDuration())
+    if err != nil {
+        return err
+    }
+    h := jobs.Handler(func(job *server.Job) {
+        task, err := q.NewTask(job)
+        if err != nil {
+            job.Deny(err)
+            return
+        }
+        defer task.Stop()
+        job.HandleWith(task)
+        select {
+        case <-job.Stopped:
+        case <-task.Stopped:
+        }
+    })
+    mux.Handle(server.JobsPath, h)
+    mux.Handle(server.JobsPath+"/", h)
+    return nil
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+    "errors"
+    "flag"
+
+    "asyonline/server/config"
+    "asyonline/server/queue"
+)
+
+// serveScheduler runs the scheduler of a Redis queue. It does not
+// listen; frontends and backends only talk to Redis.
+func serveScheduler(name string, args []string) error {
+    fs := flag.NewFlagSet(name, flag.ExitOnError)
+    cfg, err := config.Load(fs, args, config.BindScheduler)
+    if err != nil {
+        return err
+    }
+    if err := cfg.Queue.Validate(); err != nil {
+        return err
+    }
+    if cfg.Queue.Redis == "" {
+        return errors.New("queue: 'redis' must be set")
+    }
+    queue.NewScheduler(cfg.Queue.QueueConfig()).Run()
+    return nil
+}
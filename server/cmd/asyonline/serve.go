@@ -0,0 +1,68 @@
+package main
+
+import (
+    "flag"
+    "net/http"
+
+    "asyonline/server/asy"
+    "asyonline/server/config"
+    "asyonline/server/queue"
+)
+
+// serve runs the queue with the backend in the same process.
+// Tasks are passed from the queue to the backend directly,
+// and interactive sessions are served by the backend, bypassing the queue.
+func serve(name string, args []string) error {
+    fs := flag.NewFlagSet(name, flag.ExitOnError)
+    cfg, err := config.Load(fs, args, config.BindServe)
+    if err != nil {
+        return err
+    }
+    if err := cfg.Backend.Validate(); err != nil {
+        return err
+    }
+    if err := cfg.Queue.Validate(); err != nil {
+        return err
+    }
+    b, err := newBackend(&cfg.Backend)
+    if err != nil {
+        return err
+    }
+    queueConfig := cfg.Queue.QueueConfig()
+    queueConfig.Results, err = newResults(&cfg.Queue.Results, cfg.Backend.Asy)
+    if err != nil {
+        return err
+    }
+    queueConfig.Backends = nil
+    queueConfig.Redis = ""
+    queueConfig.Local = func(conn queue.LocalConn) (queue.LocalTask, error) {
+        task, err := asy.NewTask(conn, b.config)
+        if err != nil {
+            return nil, err
+        }
+        return task, nil
+    }
+    queueConfig.LocalCapacity = cfg.Backend.Capacity
+    q := queue.NewQueue(queueConfig)
+    mux := http.NewServeMux()
+    mux.Handle("/asy", queueHandler(q, &cfg.Queue))
+    mux.Handle("/asy/compile", compileHandler(q))
+    version, err := resultsVersion(&cfg.Queue.Results, cfg.Backend.Asy)
+    if err != nil {
+        return err
+    }
+    handleRender(mux, q, &cfg.Queue, version)
+    if cfg.Queue.Jobs.Dir != "" {
+        if err := handleJobs(mux, q, &cfg.Queue.Jobs); err != nil {
+            return err
+        }
+    }
+    mux.Handle("/asy/interactive", b.interactiveHandler())
+    if cfg.Queue.AdminToken != "" {
+        mux.Handle("/admin/", adminHandler(q, cfg.Queue.AdminToken))
+    }
+    if cfg.Queue.WorkerToken != "" {
+        handleWorkers(mux, q, cfg.Queue.WorkerToken)
+    }
+    return listen(cfg.Queue.Listen, mux)
+}
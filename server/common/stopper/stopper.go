@@ -25,3 +25,7 @@ func (s Stopper) Stop() {
     s.stopFunc()
 }
 
+// Done returns the Stopped channel, for use in interfaces
+func (s Stopper) Done() <-chan void {
+    return s.Stopped
+}
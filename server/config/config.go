@@ -0,0 +1,369 @@
+// Package config reads settings of the servers from a configuration file,
+// environment variables and command-line flags, in order of increasing
+// priority. See asyonline.example.json for the file format.
+package config
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "os"
+    "strings"
+    "time"
+
+    "asyonline/server/asy"
+    "asyonline/server/queue"
+)
+
+type Config struct {
+    Backend Backend `json:"backend"`
+    Queue   Queue   `json:"queue"`
+}
+
+type Backend struct {
+    Listen   string `json:"listen"`
+    Capacity int    `json:"capacity"`
+    // "direct" or "namespace", see asy.Runner
+    Runner string `json:"runner"`
+    // path to asy executable
+    Asy string `json:"asy"`
+    // read-only directories of the "namespace" runner
+    ReadOnly []string `json:"readOnly"`
+    TempDir  string   `json:"tempDir"`
+    // seconds
+    MaxDuration            float64  `json:"maxDuration"`
+    MaxInteractiveDuration float64  `json:"maxInteractiveDuration"`
+    MaxOutput              int      `json:"maxOutput"`
+    Formats                []string `json:"formats"`
+    Limits                 Limits   `json:"limits"`
+    Cgroup                 Cgroup   `json:"cgroup"`
+    Sources                Sources  `json:"sources"`
+    // address of the Redis server to take tasks from
+    // (empty to accept tasks from the queue at "/asy")
+    Redis string `json:"redis"`
+    // address of the backend as seen by queue frontends
+    // (defaults to listen)
+    Advertise string `json:"advertise"`
+    // URL of the queue to connect to as a worker, like
+    // "ws://queue:8080/worker" (empty to accept tasks at "/asy")
+    Queue string `json:"queue"`
+    // workerToken of the queue
+    QueueToken string  `json:"queueToken"`
+    Results    Results `json:"results"`
+}
+
+type Limits struct {
+    // seconds
+    CPUTime      float64 `json:"cpuTime"`
+    AddressSpace uint64  `json:"addressSpace"`
+    FileSize     uint64  `json:"fileSize"`
+    Processes    uint64  `json:"processes"`
+    OpenFiles    uint64  `json:"openFiles"`
+}
+
+type Cgroup struct {
+    Parent    string  `json:"parent"`
+    MemoryMax uint64  `json:"memoryMax"`
+    CPUMax    float64 `json:"cpuMax"`
+    PidsMax   uint64  `json:"pidsMax"`
+}
+
+// result cache, see results.Store
+type Results struct {
+    // directory of the cache, not shared with other servers
+    // (empty to disable the cache)
+    Dir string `json:"dir"`
+    // bytes
+    Size int64 `json:"size"`
+    // versions of asy and TeX, part of keys of results
+    // (detected from asy if empty, required on queues without a backend)
+    Version string `json:"version"`
+}
+
+// source cache of the "restore" sub-protocol
+type Sources struct {
+    Size int `json:"size"`
+    // seconds
+    TTL float64 `json:"ttl"`
+}
+
+type Queue struct {
+    Listen      string   `json:"listen"`
+    Backends    []string `json:"backends"`
+    MaxDuration float64  `json:"maxDuration"`
+    // "fast", "medium" and "slow" tiers, see queue.Level
+    Levels []Level `json:"levels"`
+    // scheduling policy: "fifo", "shortest" or "fair", see queue.Policy
+    Policy  string  `json:"policy"`
+    Sources Sources `json:"sources"`
+    Jobs    Jobs    `json:"jobs"`
+    // cache of images of "/asy/render.<format>"
+    Render  Sources `json:"render"`
+    Results Results `json:"results"`
+    // bearer token of the admin API at "/admin/"
+    // (empty to disable the API)
+    AdminToken string `json:"adminToken"`
+    // address of the Redis server of a distributed queue
+    // (empty to dispatch tasks to backends directly)
+    Redis string `json:"redis"`
+    // bearer token of backends that connect at "/worker"
+    // (empty to disable connecting)
+    WorkerToken string `json:"workerToken"`
+}
+
+// job API at "/asy/jobs"
+type Jobs struct {
+    // directory for outcomes of jobs (empty to disable the API)
+    Dir string `json:"dir"`
+    // seconds
+    TTL float64 `json:"ttl"`
+}
+
+type Level struct {
+    // seconds
+    Duration float64 `json:"duration"`
+    Share    float64 `json:"share"`
+}
+
+func Default() *Config {
+    a := asy.DefaultConfig()
+    q := queue.DefaultConfig()
+    sources := Sources{
+        Size: 64 << 20, // 64MiB
+        TTL:  600,
+    }
+    results := Results{Size: 256 << 20} // 256MiB
+    return &Config{
+        Backend: Backend{
+            Listen:                 "localhost:8081",
+            Capacity:               1,
+            Runner:                 "direct",
+            Asy:                    a.Runner.(*asy.DirectRunner).Path,
+            ReadOnly:               clone(asy.DefaultReadOnly),
+            TempDir:                a.TempDir,
+            MaxDuration:            a.MaxDuration,
+            MaxInteractiveDuration: a.MaxInteractiveDuration,
+            MaxOutput:              a.MaxOutput,
+            Formats:                clone(a.Formats),
+            Limits: Limits{
+                CPUTime:      a.Limits.CPUTime.Seconds(),
+                AddressSpace: a.Limits.AddressSpace,
+                FileSize:     a.Limits.FileSize,
+                Processes:    a.Limits.Processes,
+                OpenFiles:    a.Limits.OpenFiles,
+            },
+            Sources: sources,
+            Results: results,
+        },
+        Queue: Queue{
+            Listen:      "localhost:8080",
+            Backends:    clone(q.Backends),
+            MaxDuration: q.MaxDuration,
+            Levels:      levels(q.Levels),
+            Policy:      q.Policy,
+            Sources:     sources,
+            Jobs:        Jobs{TTL: 86400},
+            Render:      sources,
+            Results:     results,
+        },
+    }
+}
+
+// readFile overrides c with settings from the JSON file at path
+func (c *Config) readFile(path string) error {
+    file, err := os.Open(path)
+    if err != nil {
+        return err
+    }
+    defer file.Close()
+    decoder := json.NewDecoder(file)
+    decoder.DisallowUnknownFields()
+    if err := decoder.Decode(c); err != nil {
+        return fmt.Errorf("%s: %w", path, err)
+    }
+    return nil
+}
+
+func (b *Backend) Validate() error {
+    if b.Listen == "" {
+        return errors.New("backend: 'listen' must be set")
+    }
+    if b.Capacity < 1 {
+        return errors.New("backend: 'capacity' must be positive")
+    }
+    switch b.Runner {
+    case "direct", "namespace":
+    default:
+        return errors.New(
+            "backend: 'runner' must be \"direct\" or \"namespace\"")
+    }
+    if b.Asy == "" || b.TempDir == "" {
+        return errors.New("backend: 'asy' and 'tempDir' must be set")
+    }
+    if b.MaxDuration <= 0 || b.MaxInteractiveDuration <= 0 {
+        return errors.New("backend: durations must be positive")
+    }
+    if b.MaxOutput <= 0 {
+        return errors.New("backend: 'maxOutput' must be positive")
+    }
+    if len(b.Formats) == 0 {
+        return errors.New("backend: 'formats' must not be empty")
+    }
+    for _, format := range b.Formats {
+        if !contains(asy.AllFormats, format) {
+            return fmt.Errorf("backend: unknown format %q", format)
+        }
+    }
+    if b.Limits.CPUTime < 0 || b.Cgroup.CPUMax < 0 {
+        return errors.New("backend: limits must be nonnegative")
+    }
+    if b.Sources.Size < 0 || b.Sources.TTL < 0 {
+        return errors.New("backend: 'sources' must be nonnegative")
+    }
+    if b.Results.Dir != "" && b.Results.Size <= 0 {
+        return errors.New("backend: 'size' of results must be positive")
+    }
+    if b.Redis != "" && b.Queue != "" {
+        return errors.New("backend: 'redis' and 'queue' cannot be both set")
+    }
+    if b.Redis != "" && strings.HasPrefix(b.WorkerAddr(), ":") {
+        return errors.New(
+            "backend: 'advertise' must be set to a host with 'redis'")
+    }
+    return nil
+}
+
+// WorkerAddr returns the address of the backend for queue frontends
+func (b *Backend) WorkerAddr() string {
+    if b.Advertise != "" {
+        return b.Advertise
+    }
+    return b.Listen
+}
+
+// Validate checks the settings of the queue. Backends are not checked,
+// since a queue may also run tasks in the same process.
+func (q *Queue) Validate() error {
+    if q.Listen == "" {
+        return errors.New("queue: 'listen' must be set")
+    }
+    if q.MaxDuration <= 0 {
+        return errors.New("queue: 'maxDuration' must be positive")
+    }
+    if len(q.Levels) == 0 {
+        return errors.New("queue: 'levels' must not be empty")
+    }
+    for i, level := range q.Levels {
+        if level.Share <= 0 || level.Share > 1 {
+            return errors.New("queue: 'share' of levels must be in (0, 1]")
+        }
+        if i == 0 {
+            continue
+        }
+        if level.Duration <= q.Levels[i-1].Duration {
+            return errors.New(
+                "queue: 'duration' of levels must be increasing")
+        }
+        if level.Share > q.Levels[i-1].Share {
+            return errors.New(
+                "queue: 'share' of levels must be nonincreasing")
+        }
+    }
+    if _, ok := queue.Policies[q.Policy]; !ok {
+        return fmt.Errorf("queue: unknown policy %q", q.Policy)
+    }
+    if q.Sources.Size < 0 || q.Sources.TTL < 0 {
+        return errors.New("queue: 'sources' must be nonnegative")
+    }
+    if q.Render.Size < 0 || q.Render.TTL < 0 {
+        return errors.New("queue: 'render' must be nonnegative")
+    }
+    if q.Results.Dir != "" && q.Results.Size <= 0 {
+        return errors.New("queue: 'size' of results must be positive")
+    }
+    if q.Jobs.Dir != "" && q.Jobs.TTL <= 0 {
+        return errors.New("queue: 'ttl' of jobs must be positive")
+    }
+    return nil
+}
+
+// AsyConfig converts the settings for package asy
+func (b *Backend) AsyConfig() *asy.Config {
+    var runner asy.Runner
+    switch b.Runner {
+    case "namespace":
+        runner = &asy.NamespaceRunner{Path: b.Asy, ReadOnly: b.ReadOnly}
+    default:
+        runner = &asy.DirectRunner{Path: b.Asy}
+    }
+    return &asy.Config{
+        Runner:                 runner,
+        TempDir:                b.TempDir,
+        MaxDuration:            b.MaxDuration,
+        MaxInteractiveDuration: b.MaxInteractiveDuration,
+        MaxOutput:              b.MaxOutput,
+        Formats:                b.Formats,
+        Limits: asy.Limits{
+            CPUTime:      seconds(b.Limits.CPUTime),
+            AddressSpace: b.Limits.AddressSpace,
+            FileSize:     b.Limits.FileSize,
+            Processes:    b.Limits.Processes,
+            OpenFiles:    b.Limits.OpenFiles,
+        },
+        Cgroup: asy.CgroupConfig{
+            Parent:    b.Cgroup.Parent,
+            MemoryMax: b.Cgroup.MemoryMax,
+            CPUMax:    b.Cgroup.CPUMax,
+            PidsMax:   b.Cgroup.PidsMax,
+        },
+    }
+}
+
+// QueueConfig converts the settings for package queue
+func (q *Queue) QueueConfig() *queue.Config {
+    config := &queue.Config{
+        Backends:    q.Backends,
+        MaxDuration: q.MaxDuration,
+        Redis:       q.Redis,
+        Policy:      q.Policy,
+    }
+    for _, level := range q.Levels {
+        config.Levels = append(config.Levels,
+            queue.Level{Duration: level.Duration, Share: level.Share})
+    }
+    return config
+}
+
+func (s *Sources) TTLDuration() time.Duration {
+    return seconds(s.TTL)
+}
+
+func (j *Jobs) TTLDuration() time.Duration {
+    return seconds(j.TTL)
+}
+
+func seconds(s float64) time.Duration {
+    return time.Duration(s * float64(time.Second))
+}
+
+func contains(items []string, item string) bool {
+    for _, x := range items {
+        if x == item {
+            return true
+        }
+    }
+    return false
+}
+
+func levels(levels []queue.Level) []Level {
+    var result []Level
+    for _, level := range levels {
+        result = append(result, Level{level.Duration, level.Share})
+    }
+    return result
+}
+
+// clone copies defaults, so that decoding JSON does not overwrite them
+func clone(items []string) []string {
+    return append([]string(nil), items...)
+}
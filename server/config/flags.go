@@ -0,0 +1,169 @@
+package config
+
+import (
+    "flag"
+    "fmt"
+    "io/ioutil"
+    "os"
+    "strings"
+)
+
+const envPrefix = "ASYONLINE_"
+
+// Load reads the configuration file given by -config flag (or
+// ASYONLINE_CONFIG environment variable), then environment variables,
+// then flags. Flags are defined on fs by bind functions, and each flag
+// can be set with the environment variable ASYONLINE_<FLAG_NAME>.
+func Load(fs *flag.FlagSet, args []string,
+    bind ...func(fs *flag.FlagSet, c *Config),
+) (*Config, error) {
+    var path string
+    { // only look for -config flag
+        pre := flag.NewFlagSet(fs.Name(), flag.ContinueOnError)
+        pre.SetOutput(ioutil.Discard)
+        pre.StringVar(&path, "config", os.Getenv(envPrefix+"CONFIG"), "")
+        for _, b := range bind {
+            b(pre, Default())
+        }
+        pre.Parse(args) // errors are reported below
+    }
+    c := Default()
+    if path != "" {
+        if err := c.readFile(path); err != nil {
+            return nil, err
+        }
+    }
+    fs.String("config", path, "configuration file (JSON)")
+    for _, b := range bind {
+        b(fs, c)
+    }
+    var err error
+    fs.VisitAll(func(f *flag.Flag) {
+        name := envName(f.Name)
+        if value, ok := os.LookupEnv(name); ok && err == nil {
+            if errx := fs.Set(f.Name, value); errx != nil {
+                err = fmt.Errorf("%s: %w", name, errx)
+            }
+        }
+    })
+    if err != nil {
+        return nil, err
+    }
+    if err := fs.Parse(args); err != nil {
+        return nil, err
+    }
+    return c, nil
+}
+
+func envName(flagName string) string {
+    return envPrefix +
+        strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+func BindBackend(fs *flag.FlagSet, c *Config) {
+    b := &c.Backend
+    fs.StringVar(&b.Listen, "listen", b.Listen, "address to listen on")
+    fs.Float64Var(&b.MaxDuration, "max-duration", b.MaxDuration,
+        "maximum duration of a task, seconds")
+    fs.StringVar(&b.Redis, "redis", b.Redis,
+        "address of Redis server to take tasks from")
+    fs.StringVar(&b.Advertise, "advertise", b.Advertise,
+        "address of the backend for queue frontends (defaults to -listen)")
+    fs.StringVar(&b.Queue, "queue", b.Queue,
+        "URL of a queue to connect to as a worker")
+    fs.StringVar(&b.QueueToken, "queue-token", b.QueueToken,
+        "bearer token of workers of the queue")
+    fs.StringVar(&b.Results.Dir, "results-dir", b.Results.Dir,
+        "directory of the result cache (empty to disable it)")
+    bindAsy(fs, b)
+}
+
+func BindQueue(fs *flag.FlagSet, c *Config) {
+    q := &c.Queue
+    fs.StringVar(&q.Listen, "listen", q.Listen, "address to listen on")
+    fs.Var(listValue{&q.Backends}, "backends",
+        "backend addresses, comma-separated")
+    fs.Float64Var(&q.MaxDuration, "max-duration", q.MaxDuration,
+        "maximum duration of a task, seconds")
+    fs.StringVar(&q.Policy, "policy", q.Policy,
+        "scheduling policy: \"fifo\", \"shortest\" or \"fair\"")
+    fs.StringVar(&q.Jobs.Dir, "jobs-dir", q.Jobs.Dir,
+        "directory for outcomes of jobs (empty to disable the job API)")
+    fs.StringVar(&q.Results.Dir, "results-dir", q.Results.Dir,
+        "directory of the result cache (empty to disable it)")
+    fs.StringVar(&q.AdminToken, "admin-token", q.AdminToken,
+        "bearer token of the admin API (empty to disable it)")
+    fs.StringVar(&q.Redis, "redis", q.Redis,
+        "address of Redis server of a distributed queue")
+    fs.StringVar(&q.WorkerToken, "worker-token", q.WorkerToken,
+        "bearer token of backends that connect to the queue")
+}
+
+// BindScheduler defines flags for the scheduler of a Redis queue
+func BindScheduler(fs *flag.FlagSet, c *Config) {
+    q := &c.Queue
+    fs.StringVar(&q.Redis, "redis", q.Redis, "address of Redis server")
+    fs.Float64Var(&q.MaxDuration, "max-duration", q.MaxDuration,
+        "maximum duration of a task, seconds")
+    fs.StringVar(&q.Policy, "policy", q.Policy,
+        "scheduling policy: \"fifo\", \"shortest\" or \"fair\"")
+}
+
+// BindServe defines flags for the queue and backend running in one
+// process. The backend does not listen on its own.
+func BindServe(fs *flag.FlagSet, c *Config) {
+    q := &c.Queue
+    fs.StringVar(&q.Listen, "listen", q.Listen, "address to listen on")
+    fs.Float64Var(&q.MaxDuration, "max-duration", q.MaxDuration,
+        "maximum duration of a task, seconds")
+    fs.StringVar(&q.Policy, "policy", q.Policy,
+        "scheduling policy: \"fifo\", \"shortest\" or \"fair\"")
+    fs.StringVar(&q.Jobs.Dir, "jobs-dir", q.Jobs.Dir,
+        "directory for outcomes of jobs (empty to disable the job API)")
+    fs.StringVar(&q.Results.Dir, "results-dir", q.Results.Dir,
+        "directory of the result cache (empty to disable it)")
+    fs.StringVar(&q.AdminToken, "admin-token", q.AdminToken,
+        "bearer token of the admin API (empty to disable it)")
+    fs.StringVar(&q.WorkerToken, "worker-token", q.WorkerToken,
+        "bearer token of backends that connect to the queue")
+    bindAsy(fs, &c.Backend)
+}
+
+// bindAsy defines flags for running Asymptote
+func bindAsy(fs *flag.FlagSet, b *Backend) {
+    fs.IntVar(&b.Capacity, "capacity", b.Capacity,
+        "number of concurrent tasks")
+    fs.StringVar(&b.Runner, "runner", b.Runner,
+        "how to run asy: \"direct\" or \"namespace\"")
+    fs.StringVar(&b.Asy, "asy", b.Asy, "path to asy executable")
+    fs.StringVar(&b.TempDir, "tempdir", b.TempDir,
+        "directory for working directories of tasks")
+    fs.IntVar(&b.MaxOutput, "max-output", b.MaxOutput,
+        "maximum output of a task, bytes")
+    fs.Var(listValue{&b.Formats}, "formats",
+        "allowed output formats, comma-separated")
+    fs.StringVar(&b.Cgroup.Parent, "cgroup", b.Cgroup.Parent,
+        "parent cgroup for tasks (empty to disable cgroups)")
+}
+
+// listValue is a comma-separated flag value
+type listValue struct {
+    items *[]string
+}
+
+func (l listValue) String() string {
+    if l.items == nil {
+        return ""
+    }
+    return strings.Join(*l.items, ",")
+}
+
+func (l listValue) Set(value string) error {
+    *l.items = nil
+    for _, item := range strings.Split(value, ",") {
+        if item = strings.TrimSpace(item); item != "" {
+            *l.items = append(*l.items, item)
+        }
+    }
+    return nil
+}
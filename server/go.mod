@@ -3,7 +3,12 @@ module asyonline/server
 go 1.20
 
 require (
-	github.com/gorilla/websocket v1.5.0
+	github.com/redis/go-redis/v9 v9.0.5
 	golang.org/x/net v0.8.0
 	golang.org/x/sys v0.6.0
 )
+
+require (
+	github.com/cespare/xxhash/v2 v2.2.0 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+)
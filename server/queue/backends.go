@@ -1,35 +1,146 @@
 package queue
 
 import (
+    "encoding/json"
+    "fmt"
+    "log"
+    "net"
+    "net/http"
+    "time"
+
     "golang.org/x/net/websocket"
+
+    "asyonline/server/server"
 )
 
-type backend struct {
+// backend runs tasks, as many at a time as the capacity of its member
+type backend interface {
+    // run runs the started task t with the given duration, passing on
+    // updates of the duration, and returns when the task is complete.
+    // An error is returned if the backend could not take the task,
+    // before anything was sent to the client.
+    run(t *Task, duration float64, durations <-chan float64) error
+}
+
+// connection timeout of dials and health probes
+const dialTimeout time.Duration = 5e9 // 5s
+
+// InfoPath is the path of BackendInfo of a backend server
+const InfoPath = "/info"
+
+// BackendInfo is served by backend servers, and is probed by the queue
+type BackendInfo struct {
+    // number of concurrent tasks
+    Capacity int `json:"capacity"`
+    // number of running tasks
+    Busy int `json:"busy"`
+}
+
+// remoteBackend is a backend server, connected over websocket
+type remoteBackend struct {
     addr string
 }
 
+// newRemoteMember returns a member for the backend server at addr.
+// Its capacity is 1 until it is probed.
+func newRemoteMember(addr string) *member {
+    return &member{
+        name:     addr,
+        backend:  &remoteBackend{addr},
+        capacity: 1,
+    }
+}
+
 // create and return websocket connection
 // closing the connection is the responsibility of the caller
-func (b *backend) Dial() (*websocket.Conn, error) {
-    conn, err := websocket.Dial(
-        "ws://"+b.addr+"/asy",
-        "asyonline.asy",        // protocol
+func (b *remoteBackend) Dial() (*websocket.Conn, error) {
+    return dial("ws://"+b.addr+"/asy", nil)
+}
+
+// dial opens a websocket connection with JSON framing
+func dial(url string, header http.Header) (*websocket.Conn, error) {
+    config, err := websocket.NewConfig(
+        url,
         "http://localhost/asy", // origin
     )
     if err != nil {
         return nil, err
     }
+    for key, values := range header {
+        config.Header[key] = values
+    }
+    config.Protocol = []string{server.ProtocolJSONAsy}
+    config.Dialer = &net.Dialer{Timeout: dialTimeout}
+    conn, err := websocket.DialConfig(config)
+    if err != nil {
+        return nil, err
+    }
     return conn, nil
 }
 
-type backendPool struct {
-    input  chan<- *backend
-    output <-chan *backend
+// info checks that the backend server is up and returns its info
+func (b *remoteBackend) info() (*BackendInfo, error) {
+    client := http.Client{Timeout: dialTimeout}
+    resp, err := client.Get("http://" + b.addr + InfoPath)
+    if err != nil {
+        return nil, err
+    }
+    defer resp.Body.Close()
+    if resp.StatusCode != http.StatusOK {
+        return nil, fmt.Errorf("health probe: %s", resp.Status)
+    }
+    var info BackendInfo
+    if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+        return nil, fmt.Errorf("health probe: %w", err)
+    }
+    if info.Capacity < 1 {
+        return nil, fmt.Errorf("health probe: capacity must be positive")
+    }
+    return &info, nil
 }
 
-func newBackendPool() *backendPool {
-    // TODO some control mechanisms to remove and add backends from the pool
-    backends := make(chan *backend)
-    return &backendPool{backends, backends}
+func (b *remoteBackend) run(
+    t *Task, duration float64, durations <-chan float64,
+) error {
+    backconn, err := b.Dial()
+    if err != nil {
+        return err
+    }
+    defer backconn.Close()
+    return t.runOn(backconn, duration, durations)
 }
 
+// runOn runs the task on a backend connected over backconn. An error is
+// returned if the backend is busy.
+func (t *Task) runOn(backconn *websocket.Conn,
+    duration float64, durations <-chan float64,
+) error {
+    t.backconn = backconn
+    received := make(chan error, 1)
+    go t.receive(received)
+    err := t.sendStart(duration)
+    if err != nil {
+        log.Print(err)
+        // the backend may have denied the task before closing
+        backconn.Close()
+        return <-received
+    }
+    for {
+        select {
+        case newDuration := <-durations:
+            if newDuration < duration {
+                duration = newDuration
+            }
+            err := t.sendDuration(duration)
+            if err != nil {
+                log.Print(err)
+                backconn.Close()
+                return <-received
+            }
+        case err := <-received:
+            return err
+        case <-t.Stopped:
+            return nil
+        }
+    }
+}
@@ -1,64 +1,341 @@
 package queue
 
+import (
+    "math"
+    "math/rand"
+    "time"
+)
+
 type void = struct{}
 
-func dispatchLoop(
-    list *taskList, backends *backendPool,
-    levels []QueueLevel,
-) {
+// assignment passes a backend from the dispatcher to a waiting task
+type assignment = struct {
+    backend  backend
+    duration float64
+}
+
+type resize = struct {
+    task     *Task
+    duration float64
+}
+
+// dispatcher assigns waiting tasks to free backends following
+// the algorithm of plan-queue.md. All of its state is owned by loop;
+// loop never blocks on tasks, so tasks may send events at any time.
+type dispatcher struct {
+    levels      []Level
+    maxDuration float64
+    policy      Policy
+
+    // events
+    enqueue  chan *Task
+    resize   chan resize
+    withdraw chan *Task // task stopped while waiting
+    finished chan *Task // task stopped after it was assigned
+    requeue  chan *Task // assigned backend could not take the task
+    full     chan *Task // assigned backend was busy
+    control  chan func()
+
+    // only loop can access these
+    waiting map[*Task]*entry // ordered by policy
+    running map[*Task]*entry
+    members []*member
+    // when statuses were last updated, see updateStatuses
+    statusesAt time.Time
+}
+
+func newDispatcher(config *Config, members []*member) *dispatcher {
+    levels := config.Levels
+    if len(levels) == 0 {
+        levels = []Level{{config.MaxDuration, 1}}
+    }
+    return &dispatcher{
+        levels:      levels,
+        maxDuration: config.MaxDuration,
+        policy:      newPolicy(config.Policy),
+        enqueue:     make(chan *Task),
+        resize:      make(chan resize),
+        withdraw:    make(chan *Task),
+        finished:    make(chan *Task),
+        requeue:     make(chan *Task),
+        full:        make(chan *Task),
+        control:     make(chan func()),
+        waiting:     make(map[*Task]*entry),
+        running:     make(map[*Task]*entry),
+        members:     members,
+    }
+}
+
+func (d *dispatcher) loop() {
     // TODO add mechanism for shutting the loop down
-    // (or updating with different parameters)
-    type gateItem = struct {
-        duration float64
-        gate     chan void
-    }
-    gates := make([]gateItem, len(levels)+1)
-    // last gate is a sentinel
-    for i, level := range levels {
-        gate := make(chan void, level.limit)
-        for j := 0; j < level.limit; j++ {
-            gate <- void{}
-        }
-        gates[i] = gateItem{level.duration, gate}
+    for _, m := range d.members {
+        d.watch(m)
     }
-    var (
-        level    int     = 0
-        duration float64 = 0
-    )
+    // fires when statuses that were put off may be updated
+    var statuses <-chan time.Time
     for {
         select {
-        case <-gates[level].gate:
-            duration = gates[level].duration
-            level++
-            continue
-        default:
-        }
-        var t *Task = nil
-        select {
-        case list.filters <- duration:
-            select {
-            case <-gates[level].gate:
-                duration = gates[level].duration
-                level++
-                continue
-            case t = <-list.output:
+        case t := <-d.enqueue:
+            e := &entry{task: t, duration: t.duration, fixed: t.fixed}
+            if e.fixed {
+                e.level = d.levelOf(e.duration)
+            }
+            d.push(e, false)
+        case r := <-d.resize:
+            d.resizeTask(r.task, r.duration)
+        case t := <-d.withdraw:
+            // if the task was assigned meanwhile,
+            // its backend is returned with finished
+            if e, ok := d.waiting[t]; ok {
+                d.unqueue(e)
+            }
+        case t := <-d.finished:
+            if e, ok := d.running[t]; ok {
+                d.finish(e)
+                d.release(e.member)
+            }
+        case t := <-d.requeue:
+            if e, ok := d.running[t]; ok {
+                d.finish(e)
+                d.quarantine(e.member)
+                d.release(e.member)
+                e.attempts++
+                d.retry(e)
+            }
+        case t := <-d.full:
+            // the backend is healthy, and the task did not fail on it
+            if e, ok := d.running[t]; ok {
+                d.finish(e)
+                d.release(e.member)
+                d.fill(e.member)
+                d.retry(e)
             }
-        case t = <-list.output:
+        case f := <-d.control:
+            f()
+        case <-statuses:
+            statuses = nil
         }
-        b := <-backends.output
-        t.proceedWith(b)
-        for _, gi := range gates[:level] {
-            go func(t *Task, gi gateItem) {
-                if t.duration > gi.duration {
-                    <-t.Stopped
-                }
-                gi.gate <- void{}
-            }(t, gi)
+        for d.dispatchOne() {
         }
-        go func(t *Task, b *backend) {
+        if statuses == nil && !d.sendStatuses() {
+            statuses = time.After(statusInterval - time.Since(d.statusesAt))
+        }
+    }
+}
+
+// dispatchOne runs one cycle of the algorithm and reports whether
+// a task was started
+func (d *dispatcher) dispatchOne() bool {
+    // tasks of higher levels are ignored for the rest of the cycle
+    top := len(d.levels) - 1
+    for i := len(d.levels) - 1; i >= 1; i-- {
+        e := d.next(top)
+        if e == nil {
+            return false
+        }
+        if e.level < i || d.count(i) < d.limit(i) {
+            continue
+        }
+        d.downgrade(i)
+        if d.count(i) >= d.limit(i) {
+            top = i - 1
+        }
+    }
+    e := d.next(top)
+    if e == nil {
+        return false
+    }
+    m := d.free()
+    if m == nil {
+        // does not free backends immediately,
+        // but tasks will finish sooner
+        d.downgradeAll()
+        return false
+    }
+    select {
+    case <-e.task.Stopped:
+        // withdraw event is on its way, the backend stays free
+        d.unqueue(e)
+        return true
+    default:
+    }
+    d.start(e)
+    e.member = m
+    m.busy++
+    e.task.assigned <- assignment{m.backend, e.duration}
+    if !e.watched {
+        // one watcher for all assignments, as the entry is kept on retry
+        e.watched = true
+        go func(t *Task) {
             <-t.Stopped
-            backends.input <- b
-        }(t, b)
+            d.finished <- t
+        }(e.task)
+    }
+    return true
+}
+
+// push adds a waiting task, see Policy.Enqueue
+func (d *dispatcher) push(e *entry, retry bool) {
+    d.waiting[e.task] = e
+    d.policy.Enqueue(e, retry)
+}
+
+// next returns the waiting task of at most maxLevel
+// that the policy starts first, or nil
+func (d *dispatcher) next(maxLevel int) *entry {
+    w := d.policy.Next(maxLevel)
+    if w == nil {
+        return nil
+    }
+    return w.(*entry)
+}
+
+// order returns the waiting tasks in the order of the policy
+func (d *dispatcher) order() []*entry {
+    order := d.policy.Order()
+    entries := make([]*entry, len(order))
+    for i, w := range order {
+        entries[i] = w.(*entry)
+    }
+    return entries
+}
+
+// unqueue removes a waiting task that stopped
+func (d *dispatcher) unqueue(e *entry) {
+    delete(d.waiting, e.task)
+    d.policy.Withdraw(e)
+}
+
+// start moves a waiting task to the running ones. "Default" tasks get
+// the highest duration that the level limits allow.
+func (d *dispatcher) start(e *entry) {
+    delete(d.waiting, e.task)
+    d.policy.Start(e)
+    if !e.fixed {
+        e.level = d.allowedLevel(len(d.levels) - 1)
+        e.duration = d.durationOf(e.level)
+    }
+    e.started = time.Now()
+    d.running[e.task] = e
+}
+
+// finish forgets a running task that stopped
+func (d *dispatcher) finish(e *entry) {
+    delete(d.running, e.task)
+    d.policy.Finish(e)
+}
+
+// count returns the number of running tasks of level i or higher
+func (d *dispatcher) count(i int) int {
+    n := 0
+    for _, e := range d.running {
+        if e.level >= i {
+            n++
+        }
+    }
+    return n
+}
+
+// limit returns the maximum number of running tasks
+// of level i or higher
+func (d *dispatcher) limit(i int) int {
+    if i == 0 {
+        return d.total()
+    }
+    n := int(d.levels[i].Share * float64(d.total()))
+    if n < 1 {
+        n = 1
+    }
+    if prev := d.limit(i - 1); n > prev {
+        n = prev
+    }
+    return n
+}
+
+// allowedLevel returns the highest level, up to max, that one more task
+// can be added to without reaching limits
+func (d *dispatcher) allowedLevel(max int) int {
+    for j := 1; j <= max; j++ {
+        if d.count(j) >= d.limit(j) {
+            return j - 1
+        }
+    }
+    return max
+}
+
+func (d *dispatcher) levelOf(duration float64) int {
+    for i, level := range d.levels {
+        if duration <= level.Duration {
+            return i
+        }
+    }
+    return len(d.levels) - 1
+}
+
+func (d *dispatcher) durationOf(level int) float64 {
+    if level == len(d.levels)-1 {
+        return d.maxDuration
     }
+    return math.Min(d.levels[level].Duration, d.maxDuration)
 }
 
+// downgrade moves a random running "default" task of level i or higher,
+// preferring the highest level, below level i
+func (d *dispatcher) downgrade(i int) {
+    var candidates []*entry
+    for _, e := range d.running {
+        switch {
+        case e.fixed || e.level < i:
+        case len(candidates) == 0 || e.level == candidates[0].level:
+            candidates = append(candidates, e)
+        case e.level > candidates[0].level:
+            candidates = append(candidates[:0], e)
+        }
+    }
+    if len(candidates) == 0 {
+        return
+    }
+    e := candidates[rand.Intn(len(candidates))]
+    // the task keeps counting towards lower limits
+    e.level = d.allowedLevel(i - 1)
+    d.setDuration(e, d.durationOf(e.level))
+}
+
+// downgradeAll moves all running "default" tasks to the first level
+func (d *dispatcher) downgradeAll() {
+    for _, e := range d.running {
+        if !e.fixed && e.level > 0 {
+            e.level = 0
+            d.setDuration(e, d.durationOf(0))
+        }
+    }
+}
+
+// resizeTask applies a duration requested by the client after the start
+func (d *dispatcher) resizeTask(t *Task, duration float64) {
+    e := d.running[t]
+    if e == nil {
+        e = d.waiting[t]
+    }
+    if e == nil || duration >= e.duration {
+        return
+    }
+    e.fixed = true
+    e.level = d.levelOf(duration)
+    if e.member != nil {
+        d.setDuration(e, duration)
+    } else {
+        e.duration = duration
+    }
+}
+
+// setDuration changes the duration of a running task.
+// The task may lag behind, only the last duration is kept for it.
+func (d *dispatcher) setDuration(e *entry, duration float64) {
+    e.duration = duration
+    select {
+    case <-e.task.durations:
+    default:
+    }
+    e.task.durations <- duration
+}
@@ -0,0 +1,378 @@
+package queue
+
+import (
+    "errors"
+    "runtime"
+    "sync"
+    "testing"
+    "time"
+
+    "asyonline/server/server/message"
+)
+
+// fakeConn is the conn of a client, which records what the task sends
+type fakeConn struct {
+    mutex     sync.Mutex
+    denied    error
+    statuses  int
+    output    []byte
+    completed bool
+    // error of Complete
+    failed error
+    // SendStatus fails, as if the client went away
+    broken bool
+}
+
+func (c *fakeConn) Client() string {
+    return "client"
+}
+
+func (c *fakeConn) Deny(err error) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.denied = err
+}
+
+func (c *fakeConn) SendOutput(stream string, output []byte) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.output = append(c.output, output...)
+    return nil
+}
+
+func (c *fakeConn) SendResult(format string, contents []byte) error {
+    return nil
+}
+
+func (c *fakeConn) SendStatus(status *message.Status) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.statuses++
+    if c.broken {
+        return errors.New("client went away")
+    }
+    return nil
+}
+
+func (c *fakeConn) Complete(err error) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.completed, c.failed = true, err
+    return nil
+}
+
+func (c *fakeConn) deniedWith() error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return c.denied
+}
+
+// fakeBackend runs tasks until they stop. The first failures runs
+// fail, as if the backend could not take the task.
+type fakeBackend struct {
+    mutex    sync.Mutex
+    failures int
+    runs     int
+    // error of the failing runs
+    deny error
+    // receives tasks as they run
+    running chan *Task
+}
+
+func newFakeBackend(failures int) *fakeBackend {
+    return &fakeBackend{
+        failures: failures,
+        deny:     errors.New("backend is not available"),
+        running:  make(chan *Task, 16),
+    }
+}
+
+func (b *fakeBackend) run(
+    t *Task, duration float64, durations <-chan float64,
+) error {
+    b.mutex.Lock()
+    b.runs++
+    fail := b.runs <= b.failures
+    b.mutex.Unlock()
+    if fail {
+        return b.deny
+    }
+    b.running <- t
+    <-t.Stopped
+    return nil
+}
+
+func (b *fakeBackend) count() int {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return b.runs
+}
+
+// newTestQueue returns a queue with one backend of the given capacity
+func newTestQueue(b backend, capacity int) (*Queue, *member) {
+    config := &Config{MaxDuration: 30}
+    m := &member{name: "fake", backend: b, capacity: capacity}
+    queue := &Queue{
+        config:   config,
+        dispatch: newDispatcher(config, []*member{m}),
+        flights:  newFlights(),
+    }
+    go queue.dispatch.loop()
+    return queue, m
+}
+
+// startTask queues a started task, like Task.Start without coalescing
+func startTask(queue *Queue, conn conn) *Task {
+    t := newTask(conn, queue)
+    t.mainname = "main.asy"
+    t.started = true
+    t.launch("")
+    return t
+}
+
+// running waits until b runs a task
+func running(tb testing.TB, b *fakeBackend) *Task {
+    tb.Helper()
+    select {
+    case t := <-b.running:
+        return t
+    case <-time.After(5 * time.Second):
+        tb.Fatal("no task runs")
+        return nil
+    }
+}
+
+// settle waits until the dispatcher forgets all tasks, the backend is
+// free, and the number of goroutines is back to goroutines
+func settle(tb testing.TB, queue *Queue, m *member, goroutines int) {
+    tb.Helper()
+    d := queue.dispatch
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        var waiting, running, busy int
+        d.do(func() {
+            waiting, running, busy = len(d.waiting), len(d.running), m.busy
+        })
+        n := runtime.NumGoroutine()
+        if waiting == 0 && running == 0 && busy == 0 && n <= goroutines {
+            return
+        }
+        if time.Now().After(deadline) {
+            buf := make([]byte, 1<<16)
+            tb.Fatalf("waiting %d, running %d, busy %d, goroutines %d "+
+                "(expected %d):\n%s", waiting, running, busy, n, goroutines,
+                buf[:runtime.Stack(buf, true)])
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+// waitFor waits until f reports true in the dispatcher loop
+func waitFor(tb testing.TB, queue *Queue, f func() bool) {
+    tb.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        var ok bool
+        queue.dispatch.do(func() { ok = f() })
+        if ok {
+            return
+        }
+        if time.Now().After(deadline) {
+            tb.Fatal("timed out")
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func TestDisconnectWhileWaiting(t *testing.T) {
+    b := newFakeBackend(0)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    first := startTask(queue, &fakeConn{})
+    running(t, b)
+    second := startTask(queue, &fakeConn{})
+    d := queue.dispatch
+    waitFor(t, queue, func() bool { return d.waiting[second] != nil })
+    second.Stop()
+    waitFor(t, queue, func() bool { return d.waiting[second] == nil })
+    first.Stop()
+    settle(t, queue, m, goroutines)
+    if n := b.count(); n != 1 {
+        t.Errorf("%d runs, expected 1", n)
+    }
+}
+
+func TestDisconnectOnStatus(t *testing.T) {
+    b := newFakeBackend(0)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    first := startTask(queue, &fakeConn{})
+    running(t, b)
+    // the client goes away as the queue status is sent
+    second := startTask(queue, &fakeConn{broken: true})
+    <-second.Stopped
+    first.Stop()
+    settle(t, queue, m, goroutines)
+    if n := b.count(); n != 1 {
+        t.Errorf("%d runs, expected 1", n)
+    }
+}
+
+func TestDisconnectAtAssignment(t *testing.T) {
+    b := newFakeBackend(0)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    d := queue.dispatch
+    task := newTask(&fakeConn{}, queue)
+    task.started = true
+    d.enqueue <- task
+    // assigned, but the task loop did not take the backend yet
+    waitFor(t, queue, func() bool { return d.running[task] != nil })
+    task.Stop()
+    done := make(chan void)
+    go func() {
+        task.loop()
+        close(done)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("task loop blocks")
+    }
+    settle(t, queue, m, goroutines)
+    if n := b.count(); n != 0 {
+        t.Errorf("%d runs, expected none", n)
+    }
+}
+
+func TestDisconnectWhileRunning(t *testing.T) {
+    b := newFakeBackend(0)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    task := startTask(queue, &fakeConn{})
+    running(t, b).Stop()
+    <-task.Stopped
+    settle(t, queue, m, goroutines)
+}
+
+func TestDisconnectAfterRequeue(t *testing.T) {
+    b := newFakeBackend(1)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    conn := &fakeConn{}
+    task := startTask(queue, conn)
+    running(t, b).Stop()
+    settle(t, queue, m, goroutines)
+    if n := b.count(); n != 2 {
+        t.Errorf("%d runs, expected 2", n)
+    }
+    if err := conn.deniedWith(); err != nil {
+        t.Errorf("denied: %v", err)
+    }
+    <-task.Stopped
+}
+
+func TestDisconnectWaitingAfterRequeue(t *testing.T) {
+    b := newFakeBackend(1)
+    queue, m := newTestQueue(b, 1)
+    // the backend is quarantined when it fails, and is not probed
+    m.wake = make(chan void, 1)
+    goroutines := runtime.NumGoroutine()
+    d := queue.dispatch
+    task := startTask(queue, &fakeConn{})
+    waitFor(t, queue, func() bool {
+        e := d.waiting[task]
+        return e != nil && e.attempts == 1
+    })
+    task.Stop()
+    settle(t, queue, m, goroutines)
+    if n := b.count(); n != 1 {
+        t.Errorf("%d runs, expected 1", n)
+    }
+}
+
+func TestRequeueUntilNoBackend(t *testing.T) {
+    b := newFakeBackend(maxAttempts)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    conn := &fakeConn{}
+    task := startTask(queue, conn)
+    select {
+    case <-task.Stopped:
+    case <-time.After(5 * time.Second):
+        t.Fatal("task does not stop")
+    }
+    settle(t, queue, m, goroutines)
+    if n := b.count(); n != maxAttempts {
+        t.Errorf("%d runs, expected %d", n, maxAttempts)
+    }
+    if conn.deniedWith() == nil {
+        t.Error("task was not denied")
+    }
+}
+
+func TestOneWatcherPerTask(t *testing.T) {
+    b := newFakeBackend(maxAttempts - 1)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    task := startTask(queue, &fakeConn{})
+    running(t, b)
+    // the task loop, and the watcher that reports the task as finished
+    if n := runtime.NumGoroutine() - goroutines; n != 2 {
+        t.Errorf("%d goroutines for the task, expected 2", n)
+    }
+    task.Stop()
+    settle(t, queue, m, goroutines)
+}
+
+func TestSetHealthBusy(t *testing.T) {
+    m := &member{name: "remote", capacity: 2, busy: 1}
+    d := newDispatcher(&Config{MaxDuration: 30}, []*member{m})
+    // the task of the queue, and an interactive session
+    d.setHealth(m, &BackendInfo{Capacity: 2, Busy: 2}, nil)
+    if d.free() != nil {
+        t.Error("a full backend is free")
+    }
+    d.setHealth(m, &BackendInfo{Capacity: 2, Busy: 1}, nil)
+    if d.free() != m {
+        t.Error("a backend with a free slot is not free")
+    }
+}
+
+func TestBusyBackend(t *testing.T) {
+    b := newFakeBackend(maxAttempts)
+    b.deny = errBackendBusy
+    queue, m := newTestQueue(b, 2)
+    // probed, so the backend is full until a probe
+    m.wake = make(chan void, 1)
+    goroutines := runtime.NumGoroutine()
+    d := queue.dispatch
+    conn := &fakeConn{}
+    task := startTask(queue, conn)
+    // busy denials neither quarantine the backend
+    // nor count as failed attempts
+    for i := 1; i <= maxAttempts; i++ {
+        waitFor(t, queue, func() bool {
+            return d.waiting[task] != nil && b.count() == i
+        })
+        d.do(func() {
+            if m.unhealthy || d.total() != 2 {
+                t.Errorf("unhealthy %t, total %d after a busy denial",
+                    m.unhealthy, d.total())
+            }
+            if d.free() != nil {
+                t.Error("a busy backend is free before a probe")
+            }
+            if e := d.waiting[task]; e.attempts != 0 {
+                t.Errorf("%d attempts after busy denials", e.attempts)
+            }
+            d.setHealth(m, &BackendInfo{Capacity: 2, Busy: 0}, nil)
+        })
+    }
+    running(t, b)
+    if err := conn.deniedWith(); err != nil {
+        t.Errorf("denied: %v", err)
+    }
+    task.Stop()
+    settle(t, queue, m, goroutines)
+}
@@ -0,0 +1,149 @@
+package queue
+
+import (
+    "math"
+    "sort"
+    "time"
+
+    "asyonline/server/server/message"
+)
+
+// estimates are resent when they drift from the expected value
+// by at least this much, seconds
+const estimateTolerance = 1.0
+
+// estimates of only this many first waiting tasks are computed by
+// planning, as it takes polynomial time in the number of tasks
+const maxPlanned = 32
+
+// statuses are updated at most this often
+const statusInterval time.Duration = 1e9 // 1s
+
+// interval is a running or waiting task, as planned by estimate;
+// times are in seconds from now
+type interval = struct {
+    start, end float64
+    level      int
+}
+
+// estimate returns the time after which each waiting task is expected
+// to start, in seconds. Tasks are assumed to run up to their limits, and
+// are placed in order of the queue at the earliest time when the level
+// limits allow them, so that the estimate of a task only depends on
+// the tasks before it. Tasks after the first maxPlanned ones are assumed
+// to start one after another on all backends at once.
+func (d *dispatcher) estimate(now time.Time, order []*entry) []float64 {
+    planned := make([]interval, 0, len(d.running)+len(d.waiting))
+    for _, e := range d.running {
+        end := e.duration - now.Sub(e.started).Seconds()
+        planned = append(planned, interval{0, math.Max(end, 0), e.level})
+    }
+    estimates := make([]float64, 0, len(order))
+    for i, e := range order {
+        duration := e.duration
+        if !e.fixed {
+            // likely to be downgraded under load
+            duration = d.durationOf(0)
+        }
+        if i >= maxPlanned {
+            start := estimates[i-1]
+            if total := d.total(); total > 0 {
+                start += duration / float64(total)
+            }
+            estimates = append(estimates, start)
+            continue
+        }
+        // candidate start times are ends of planned tasks
+        candidates := []float64{0}
+        for _, p := range planned {
+            candidates = append(candidates, p.end)
+        }
+        sort.Float64s(candidates)
+        start := candidates[len(candidates)-1]
+        for _, t := range candidates {
+            if d.fits(planned, t, t+duration, e.level) {
+                start = t
+                break
+            }
+        }
+        planned = append(planned, interval{start, start + duration, e.level})
+        estimates = append(estimates, start)
+    }
+    return estimates
+}
+
+// fits reports whether a task of the given level can run from start
+// to end along with the planned ones
+func (d *dispatcher) fits(planned []interval, start, end float64, level int,
+) bool {
+    if d.total() == 0 {
+        return false
+    }
+    // the number of running tasks only grows at starts of tasks
+    points := []float64{start}
+    for _, p := range planned {
+        if start < p.start && p.start < end {
+            points = append(points, p.start)
+        }
+    }
+    for _, t := range points {
+        for i := 0; i <= level; i++ {
+            n := 0
+            for _, p := range planned {
+                if p.start <= t && t < p.end && p.level >= i {
+                    n++
+                }
+            }
+            if n >= d.limit(i) {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// sendStatuses sends estimates and positions to waiting tasks
+// whose status changed, see updateStatuses
+func (d *dispatcher) sendStatuses() bool {
+    return d.updateStatuses(func(e *entry, status message.QueueStatus) {
+        select {
+        case <-e.task.statuses:
+        default:
+        }
+        e.task.statuses <- status
+    })
+}
+
+// updateStatuses calls send for each waiting task whose estimate or
+// position changed since it was last sent. It reports false if statuses
+// were updated less than statusInterval ago, and must be called again.
+func (d *dispatcher) updateStatuses(
+    send func(e *entry, status message.QueueStatus),
+) bool {
+    if len(d.waiting) == 0 {
+        return true
+    }
+    now := time.Now()
+    if now.Sub(d.statusesAt) < statusInterval {
+        return false
+    }
+    d.statusesAt = now
+    order := d.order()
+    estimates := d.estimate(now, order)
+    for i, e := range order {
+        status := message.QueueStatus{
+            Estimate: estimates[i],
+            Position: i + 1,
+        }
+        if e.sent != nil && e.sent.Position == status.Position {
+            // estimates decrease as time passes
+            expected := e.sent.Estimate - now.Sub(e.sentAt).Seconds()
+            if math.Abs(status.Estimate-expected) < estimateTolerance {
+                continue
+            }
+        }
+        e.sent, e.sentAt = &status, now
+        send(e, status)
+    }
+    return true
+}
@@ -0,0 +1,305 @@
+package queue
+
+import (
+    "fmt"
+    "math"
+    "sync"
+
+    "asyonline/server/server/message"
+    "asyonline/server/server/results"
+)
+
+// flights coalesce identical tasks: while a task is queued or running,
+// identical tasks of other clients subscribe to it instead of being
+// queued, see plan-queue.md
+type flights struct {
+    mutex sync.Mutex
+    byKey map[string]*flight
+}
+
+func newFlights() *flights {
+    return &flights{byKey: make(map[string]*flight)}
+}
+
+// flight is a task that runs on behalf of identical tasks, its
+// subscribers. It is the conn of the shared task, and passes messages
+// on to the conns of all subscribers. The shared task stops when
+// the last subscriber does.
+type flight struct {
+    flights *flights
+    key     string
+    // client of the first subscriber, for the scheduling policy
+    client string
+    task   *Task
+
+    mutex       sync.Mutex
+    subscribers []*subscriber
+    // last queue status, and output and results so far,
+    // sent to subscribers that come later
+    status *message.Status
+    events []results.Event
+    // the shared task completed or was denied
+    done bool
+    // the shared task stopped
+    ended bool
+
+    // serializes duration updates of the shared task, see resize
+    resizing sync.Mutex
+    // last duration passed to the shared task
+    duration float64
+}
+
+// subscriber is a task of a flight with the messages that are not sent
+// to its conn yet. Each subscriber is sent messages by its own relay,
+// so that a slow client holds up neither the flight nor other clients.
+type subscriber struct {
+    task *Task
+    // lowest duration requested by the client
+    duration float64
+    // sync: flight.mutex must be held
+    pending []func(c conn) error
+    // signals pending messages, or the end of the flight
+    wake chan void
+}
+
+// flightKey identifies identical tasks
+func (t *Task) flightKey() string {
+    key := results.Key("", t.sources, t.mainname,
+        t.format, t.verbosity, t.stderrRedir)
+    return fmt.Sprintf("%s %g %t", key, t.duration, t.fixed)
+}
+
+// join subscribes the started task t to the flight of identical tasks.
+// If there is none, a shared task is created for t, and it is returned
+// to be launched.
+func (fs *flights) join(t *Task) *Task {
+    key := t.flightKey()
+    fs.mutex.Lock()
+    defer fs.mutex.Unlock()
+    f, ok := fs.byKey[key]
+    if !ok {
+        f = &flight{flights: fs, key: key, client: t.client}
+        f.task = newTask(f, t.queue)
+        f.task.sources = t.sources
+        f.task.mainname = t.mainname
+        f.task.duration = t.duration
+        f.task.fixed = t.fixed
+        f.task.format = t.format
+        f.task.stderrRedir = t.stderrRedir
+        f.task.verbosity = t.verbosity
+        f.task.started = true
+        f.duration = t.duration
+        fs.byKey[key] = f
+        go f.watch()
+    }
+    t.flight = f
+    go f.relay(f.subscribe(t))
+    if ok {
+        return nil
+    }
+    return f.task
+}
+
+// subscribe adds t to the subscribers, with the messages sent so far
+// pending for it
+//
+// sync: fs.mutex must be held
+func (f *flight) subscribe(t *Task) *subscriber {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    s := &subscriber{task: t, duration: t.duration, wake: make(chan void, 1)}
+    f.subscribers = append(f.subscribers, s)
+    if len(f.events) == 0 {
+        if status := f.status; status != nil {
+            s.push(func(c conn) error { return c.SendStatus(status) })
+        }
+        return s
+    }
+    for _, e := range f.events {
+        e := e
+        s.push(func(c conn) error { return e.SendTo(c) })
+    }
+    return s
+}
+
+// relay sends pending messages to a subscriber, in order, until it
+// stops. A subscriber is stopped on errors, like a task whose client
+// went away, and after the messages of a flight that ended.
+func (f *flight) relay(s *subscriber) {
+    for {
+        select {
+        case <-s.task.Stopped:
+            f.leave(s.task)
+            return
+        default:
+        }
+        f.mutex.Lock()
+        pending, ended := s.pending, f.ended
+        s.pending = nil
+        f.mutex.Unlock()
+        for _, message := range pending {
+            if err := message(s.task.conn); err != nil {
+                s.task.Stop()
+                break
+            }
+        }
+        if ended {
+            s.task.Stop()
+            continue
+        }
+        select {
+        case <-s.task.Stopped:
+        case <-s.wake:
+        }
+    }
+}
+
+// push adds a message for the subscriber to send
+//
+// sync: flight.mutex must be held
+func (s *subscriber) push(message func(c conn) error) {
+    s.pending = append(s.pending, message)
+    s.signal()
+}
+
+func (s *subscriber) signal() {
+    select {
+    case s.wake <- void{}:
+    default:
+    }
+}
+
+// leave unsubscribes t, and stops the shared task if no subscribers remain
+func (f *flight) leave(t *Task) {
+    f.flights.mutex.Lock()
+    f.mutex.Lock()
+    for i, s := range f.subscribers {
+        if s.task == t {
+            f.subscribers = append(f.subscribers[:i], f.subscribers[i+1:]...)
+            break
+        }
+    }
+    abandoned := len(f.subscribers) == 0 && !f.done
+    if abandoned && f.flights.byKey[f.key] == f {
+        delete(f.flights.byKey, f.key)
+    }
+    remaining, longest := len(f.subscribers), f.longest()
+    f.mutex.Unlock()
+    f.flights.mutex.Unlock()
+    if abandoned {
+        f.task.Stop()
+    } else if remaining > 0 {
+        f.setDuration(longest)
+    }
+}
+
+// resize applies a duration requested by subscriber t after the start.
+// The shared task runs as long as the subscriber that allows the longest
+// duration, so that no client cuts the task short for the others.
+func (f *flight) resize(t *Task, duration float64) {
+    f.mutex.Lock()
+    for _, s := range f.subscribers {
+        if s.task == t {
+            s.duration = math.Min(s.duration, duration)
+        }
+    }
+    longest := f.longest()
+    f.mutex.Unlock()
+    f.setDuration(longest)
+}
+
+// longest returns the longest duration of the subscribers
+//
+// sync: f.mutex must be held
+func (f *flight) longest() float64 {
+    longest := 0.0
+    for _, s := range f.subscribers {
+        longest = math.Max(longest, s.duration)
+    }
+    return longest
+}
+
+// setDuration passes a duration to the shared task if it is lower
+// than the last one, as higher ones are ignored
+func (f *flight) setDuration(duration float64) {
+    f.resizing.Lock()
+    defer f.resizing.Unlock()
+    if duration >= f.duration {
+        return
+    }
+    f.duration = duration
+    f.task.SetDuration(duration)
+}
+
+// watch stops the subscribers when the shared task stops, once their
+// relays send them the pending messages
+func (f *flight) watch() {
+    <-f.task.Stopped
+    f.end()
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    f.ended = true
+    for _, s := range f.subscribers {
+        s.signal()
+    }
+}
+
+// end lets identical tasks that come later start another flight
+func (f *flight) end() {
+    f.flights.mutex.Lock()
+    defer f.flights.mutex.Unlock()
+    if f.flights.byKey[f.key] == f {
+        delete(f.flights.byKey, f.key)
+    }
+}
+
+// broadcast passes a message to the relays of all subscribers, after
+// update is applied to the flight. Both happen with f.mutex held, so
+// that subscribers that come meanwhile get every message once, in order.
+func (f *flight) broadcast(update func(), message func(c conn) error) {
+    f.mutex.Lock()
+    defer f.mutex.Unlock()
+    update()
+    for _, s := range f.subscribers {
+        s.push(message)
+    }
+}
+
+func (f *flight) Client() string {
+    return f.client
+}
+
+func (f *flight) Deny(err error) {
+    f.end()
+    f.broadcast(func() { f.done = true }, func(c conn) error {
+        c.Deny(err)
+        return nil
+    })
+}
+
+func (f *flight) SendOutput(stream string, output []byte) error {
+    e := results.Event{Stream: stream, Contents: output}
+    f.broadcast(func() { f.events = append(f.events, e) },
+        func(c conn) error { return e.SendTo(c) })
+    return nil
+}
+
+func (f *flight) SendResult(format string, contents []byte) error {
+    e := results.Event{Format: format, Contents: contents}
+    f.broadcast(func() { f.events = append(f.events, e) },
+        func(c conn) error { return e.SendTo(c) })
+    return nil
+}
+
+func (f *flight) SendStatus(status *message.Status) error {
+    f.broadcast(func() { f.status = status },
+        func(c conn) error { return c.SendStatus(status) })
+    return nil
+}
+
+func (f *flight) Complete(err error) error {
+    f.end()
+    f.broadcast(func() { f.done = true },
+        func(c conn) error { return c.Complete(err) })
+    return nil
+}
@@ -0,0 +1,251 @@
+package queue
+
+import (
+    "runtime"
+    "testing"
+    "time"
+
+    "asyonline/server/server/message"
+)
+
+// slowConn is the conn of a client that does not take messages until
+// it is released
+type slowConn struct {
+    *fakeConn
+    release chan void
+}
+
+func newSlowConn() *slowConn {
+    return &slowConn{fakeConn: &fakeConn{}, release: make(chan void)}
+}
+
+func (c *slowConn) SendOutput(stream string, output []byte) error {
+    <-c.release
+    return c.fakeConn.SendOutput(stream, output)
+}
+
+func (c *slowConn) SendStatus(status *message.Status) error {
+    <-c.release
+    return c.fakeConn.SendStatus(status)
+}
+
+func (c *slowConn) Complete(err error) error {
+    <-c.release
+    return c.fakeConn.Complete(err)
+}
+
+// newFlightQueue returns a queue that only coalesces tasks,
+// no task is launched
+func newFlightQueue() *Queue {
+    return &Queue{config: &Config{MaxDuration: 30}, flights: newFlights()}
+}
+
+// join subscribes a started task of conn, identical to all others,
+// and returns it with the shared task
+func join(queue *Queue, conn conn) (*Task, *Task) {
+    t := newTask(conn, queue)
+    t.sources["main.asy"] = []byte("draw((0,0));")
+    t.mainname = "main.asy"
+    t.started = true
+    return t, queue.flights.join(t)
+}
+
+// until waits until f reports true
+func until(tb testing.TB, what string, f func() bool) {
+    tb.Helper()
+    deadline := time.Now().Add(5 * time.Second)
+    for !f() {
+        if time.Now().After(deadline) {
+            tb.Fatal("timed out waiting until " + what)
+        }
+        time.Sleep(time.Millisecond)
+    }
+}
+
+func stopped(t *Task) bool {
+    select {
+    case <-t.Stopped:
+        return true
+    default:
+        return false
+    }
+}
+
+func (c *fakeConn) result() (string, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    return string(c.output), c.completed
+}
+
+func TestFlightSlowSubscriber(t *testing.T) {
+    queue := newFlightQueue()
+    slow := newSlowConn()
+    first, shared := join(queue, slow)
+    f := shared.conn.(*flight)
+    fast := &fakeConn{}
+    var second *Task
+    done := make(chan void)
+    go func() {
+        defer close(done)
+        f.SendStatus(&message.Status{})
+        f.SendOutput("stdout", []byte("output"))
+        second, _ = join(queue, fast)
+        f.Complete(nil)
+    }()
+    select {
+    case <-done:
+    case <-time.After(5 * time.Second):
+        t.Fatal("the flight waits for a slow subscriber")
+    }
+    until(t, "the fast subscriber completes", func() bool {
+        _, completed := fast.result()
+        return completed
+    })
+    if _, completed := slow.result(); completed {
+        t.Error("the slow subscriber completed before it was released")
+    }
+    shared.Stop()
+    until(t, "the fast subscriber stops", func() bool {
+        return stopped(second)
+    })
+    // the slow subscriber gets everything before it stops
+    time.Sleep(10 * time.Millisecond)
+    if stopped(first) {
+        t.Error("the slow subscriber stopped with messages pending")
+    }
+    close(slow.release)
+    until(t, "the slow subscriber stops", func() bool {
+        return stopped(first)
+    })
+    if output, completed := slow.result(); output != "output" || !completed {
+        t.Errorf("slow subscriber got %q, completed %t", output, completed)
+    }
+}
+
+func TestFlightReplay(t *testing.T) {
+    queue := newFlightQueue()
+    firstConn, secondConn := &fakeConn{}, &fakeConn{}
+    first, shared := join(queue, firstConn)
+    f := shared.conn.(*flight)
+    f.SendOutput("stdout", nil)
+    f.SendOutput("stdout", []byte("a"))
+    f.SendOutput("stderr", []byte("b"))
+    second, again := join(queue, secondConn)
+    if again != nil {
+        t.Fatal("an identical task started another flight")
+    }
+    f.SendOutput("stdout", []byte("c"))
+    f.SendResult("svg", []byte("<svg/>"))
+    f.Complete(nil)
+    shared.Stop()
+    for _, task := range []*Task{first, second} {
+        until(t, "the subscribers stop", func() bool {
+            return stopped(task)
+        })
+    }
+    for _, conn := range []*fakeConn{firstConn, secondConn} {
+        output, completed := conn.result()
+        if output != "abc" || !completed {
+            t.Errorf("subscriber got %q, completed %t", output, completed)
+        }
+    }
+}
+
+func TestFlightAbandoned(t *testing.T) {
+    queue := newFlightQueue()
+    goroutines := runtime.NumGoroutine()
+    first, shared := join(queue, &fakeConn{})
+    second, _ := join(queue, &fakeConn{})
+    f := shared.conn.(*flight)
+    first.Stop()
+    until(t, "the first subscriber leaves", func() bool {
+        f.mutex.Lock()
+        defer f.mutex.Unlock()
+        return len(f.subscribers) == 1
+    })
+    if stopped(shared) {
+        t.Fatal("the shared task stopped with a subscriber left")
+    }
+    second.Stop()
+    until(t, "the shared task stops", func() bool {
+        return stopped(shared)
+    })
+    queue.flights.mutex.Lock()
+    n := len(queue.flights.byKey)
+    queue.flights.mutex.Unlock()
+    if n != 0 {
+        t.Errorf("%d flights remain", n)
+    }
+    until(t, "the relays and the watcher exit", func() bool {
+        return runtime.NumGoroutine() <= goroutines
+    })
+}
+
+// startClient starts a task of the client through Task.Start,
+// as the server does
+func startClient(tb testing.TB, queue *Queue) *Task {
+    tb.Helper()
+    t := newTask(&fakeConn{}, queue)
+    if err := t.AddFile("main.asy", []byte("draw((0,0));")); err != nil {
+        tb.Fatal(err)
+    }
+    if err := t.Start("main.asy"); err != nil {
+        tb.Fatal(err)
+    }
+    return t
+}
+
+// durationOf waits for a duration update of a running task
+func durationOf(tb testing.TB, t *Task) float64 {
+    tb.Helper()
+    select {
+    case duration := <-t.durations:
+        return duration
+    case <-time.After(5 * time.Second):
+        tb.Fatal("duration update never reached the backend")
+        return 0
+    }
+}
+
+func TestFlightDuration(t *testing.T) {
+    b := newFakeBackend(0)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    task := startClient(t, queue)
+    shared := running(t, b)
+    if err := task.SetDuration(5); err != nil {
+        t.Fatal(err)
+    }
+    if duration := durationOf(t, shared); duration != 5 {
+        t.Errorf("duration %g, expected 5", duration)
+    }
+    task.Stop()
+    settle(t, queue, m, goroutines)
+}
+
+func TestFlightDurationOfSubscribers(t *testing.T) {
+    b := newFakeBackend(0)
+    queue, m := newTestQueue(b, 1)
+    goroutines := runtime.NumGoroutine()
+    first := startClient(t, queue)
+    shared := running(t, b)
+    second := startClient(t, queue)
+    // the second subscriber still allows the full duration
+    first.SetDuration(5)
+    time.Sleep(10 * time.Millisecond)
+    select {
+    case duration := <-shared.durations:
+        t.Errorf("duration %g while a subscriber allows 30", duration)
+    default:
+    }
+    second.SetDuration(10)
+    if duration := durationOf(t, shared); duration != 10 {
+        t.Errorf("duration %g, expected 10", duration)
+    }
+    second.Stop()
+    if duration := durationOf(t, shared); duration != 5 {
+        t.Errorf("duration %g after the second left, expected 5", duration)
+    }
+    first.Stop()
+    settle(t, queue, m, goroutines)
+}
@@ -0,0 +1,125 @@
+package queue
+
+import (
+    "log"
+    "sync"
+)
+
+// LocalTask is a task that runs in the same process as the queue,
+// like asy.Task
+type LocalTask interface {
+    AddFile(filename string, contents []byte) error
+    SetDuration(duration float64) error
+    SetFormat(format string) error
+    SetStderrRedir(stderrRedir bool) error
+    SetVerbosity(verbosity int) error
+    Start(mainname string) error
+    Stop()
+    Done() <-chan void
+}
+
+// LocalConn receives output of a local task
+type LocalConn interface {
+    SendOutput(stream string, output []byte) error
+    SendResult(format string, contents []byte) error
+    Complete(err error) error
+}
+
+// localBackend runs tasks in the same process, without a websocket
+type localBackend struct {
+    newTask func(conn LocalConn) (LocalTask, error)
+}
+
+func (b *localBackend) run(
+    t *Task, duration float64, durations <-chan float64,
+) error {
+    relay := &localRelay{task: t}
+    lt, err := b.newTask(relay)
+    if err != nil {
+        t.conn.Deny(err)
+        return nil
+    }
+    defer lt.Stop()
+    if err := t.configure(lt, duration); err != nil {
+        t.conn.Deny(err)
+        return nil
+    }
+    for {
+        select {
+        case newDuration := <-durations:
+            if newDuration < duration {
+                duration = newDuration
+            }
+            if err := lt.SetDuration(duration); err != nil {
+                log.Print(err)
+                return nil
+            }
+        case <-lt.Done():
+            return nil
+        case <-t.Stopped:
+            return nil
+        }
+    }
+}
+
+// configure passes files and options of t to lt and starts it
+func (t *Task) configure(lt LocalTask, duration float64) error {
+    // sync: task loop
+    for filename, contents := range t.sources {
+        if err := lt.AddFile(filename, contents); err != nil {
+            return err
+        }
+    }
+    if err := lt.SetDuration(duration); err != nil {
+        return err
+    }
+    if t.format != "" {
+        if err := lt.SetFormat(t.format); err != nil {
+            return err
+        }
+    }
+    if err := lt.SetStderrRedir(t.stderrRedir); err != nil {
+        return err
+    }
+    if err := lt.SetVerbosity(t.verbosity); err != nil {
+        return err
+    }
+    return lt.Start(t.mainname)
+}
+
+// localRelay passes output of a local task to the client, like
+// Task.receiveLoop does for remote backends
+type localRelay struct {
+    task    *Task
+    mutex   sync.Mutex
+    started bool
+}
+
+func (r *localRelay) start() {
+    r.mutex.Lock()
+    r.started = true
+    r.mutex.Unlock()
+}
+
+func (r *localRelay) SendOutput(stream string, output []byte) error {
+    r.start()
+    return r.task.conn.SendOutput(stream, output)
+}
+
+func (r *localRelay) SendResult(format string, contents []byte) error {
+    r.start()
+    return r.task.conn.SendResult(format, contents)
+}
+
+func (r *localRelay) Complete(err error) error {
+    defer r.task.Stop()
+    r.mutex.Lock()
+    started := r.started
+    r.mutex.Unlock()
+    // errors before the start of the process are denials
+    if !started && err != nil {
+        r.task.conn.Deny(err)
+        return nil
+    }
+    return r.task.conn.Complete(err)
+}
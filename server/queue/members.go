@@ -0,0 +1,314 @@
+package queue
+
+import (
+    "log"
+    "time"
+
+    "asyonline/server/server/reply"
+)
+
+// name of backends that run tasks in the same process
+const localName = "local"
+
+const (
+    // health probes of a healthy backend
+    probeInterval time.Duration = 10e9 // 10s
+    // probes of an unhealthy backend are backed off exponentially
+    minBackoff time.Duration = 1e9  // 1s
+    maxBackoff time.Duration = 60e9 // 1min
+    // number of backends that may fail to take a task
+    maxAttempts = 3
+)
+
+// member is a backend known to the dispatcher
+type member struct {
+    // address of a remote backend, or localName
+    name    string
+    backend backend
+    // number of concurrent tasks, and of running ones
+    capacity int
+    busy     int
+    // number of tasks that the backend runs for others, like interactive
+    // sessions, as of the last probe
+    external int
+    // no new tasks are assigned to the backend
+    draining bool
+    // the backend is forgotten when its tasks finish
+    removed bool
+    // quarantined backends are not assigned tasks until a probe succeeds
+    unhealthy bool
+    // wakes the prober after a failure, see probeLoop
+    wake chan void
+    // closed when the backend is forgotten
+    stop chan void
+}
+
+// BackendStatus describes a backend of the queue
+type BackendStatus struct {
+    Addr     string `json:"addr"`
+    Capacity int    `json:"capacity"`
+    Busy     int    `json:"busy"`
+    Draining bool   `json:"draining"`
+    Healthy  bool   `json:"healthy"`
+}
+
+// free returns a backend that can run a task, or nil
+func (d *dispatcher) free() *member {
+    for _, m := range d.members {
+        if m.busy+m.external < m.capacity && !m.draining && !m.unhealthy {
+            return m
+        }
+    }
+    return nil
+}
+
+// total returns the number of tasks that backends accepting tasks
+// can run, busy or not
+func (d *dispatcher) total() int {
+    n := 0
+    for _, m := range d.members {
+        if !m.draining && !m.unhealthy {
+            n += m.capacity
+        }
+    }
+    return n
+}
+
+func (d *dispatcher) find(addr string) *member {
+    for _, m := range d.members {
+        if m.name == addr && !m.removed {
+            return m
+        }
+    }
+    return nil
+}
+
+func (d *dispatcher) forget(m *member) {
+    for i, x := range d.members {
+        if x == m {
+            d.members = append(d.members[:i], d.members[i+1:]...)
+            break
+        }
+    }
+    if m.stop != nil {
+        close(m.stop)
+    }
+}
+
+// release frees a slot of the backend after its task
+func (d *dispatcher) release(m *member) {
+    m.busy--
+    if m.removed && m.busy == 0 {
+        d.forget(m)
+    }
+}
+
+// retry puts the task back at the front of the queue
+// after its backend could not take it
+func (d *dispatcher) retry(e *entry) {
+    e.member = nil
+    e.sent = nil
+    if !e.fixed {
+        e.level = 0
+    }
+    if e.attempts >= maxAttempts {
+        // no backend
+        e.task.assigned <- assignment{}
+        return
+    }
+    d.push(e, true)
+}
+
+// watch starts health probes of a remote backend
+func (d *dispatcher) watch(m *member) {
+    remote, ok := m.backend.(*remoteBackend)
+    if !ok {
+        return
+    }
+    m.wake = make(chan void, 1)
+    m.stop = make(chan void)
+    go d.probeLoop(m, remote.info, m.wake, m.stop)
+}
+
+// fill counts the free slots of a backend that denied a task as busy
+// as taken by others, like interactive sessions, until a probe finds
+// them free. Backends without probes are free again after minBackoff.
+func (d *dispatcher) fill(m *member) {
+    m.external = m.capacity - m.busy
+    if m.wake != nil {
+        d.wakeProbe(m)
+        return
+    }
+    time.AfterFunc(minBackoff, func() {
+        d.control <- func() { m.external = 0 }
+    })
+}
+
+// quarantine stops assigning tasks to a backend that failed,
+// until a probe succeeds
+func (d *dispatcher) quarantine(m *member) {
+    if m.wake == nil {
+        return
+    }
+    if !m.unhealthy {
+        log.Printf("backend %s is unhealthy", m.name)
+    }
+    m.unhealthy = true
+    d.wakeProbe(m)
+}
+
+// wakeProbe lets the backend be probed soon
+func (d *dispatcher) wakeProbe(m *member) {
+    select {
+    case m.wake <- void{}:
+    default:
+    }
+}
+
+// probeLoop probes the backend periodically, and more often
+// after failures, with exponential backoff
+func (d *dispatcher) probeLoop(m *member, probe func() (*BackendInfo, error),
+    wake <-chan void, stop <-chan void,
+) {
+    var delay time.Duration = 0
+    backoff := minBackoff
+    for {
+        select {
+        case <-time.After(delay):
+        case <-wake:
+            // a task could not connect or was denied, probe again soon
+            delay, backoff = minBackoff, minBackoff
+            continue
+        case <-stop:
+            return
+        }
+        info, err := probe()
+        select {
+        case d.control <- func() { d.setHealth(m, info, err) }:
+        case <-stop:
+            return
+        }
+        if err == nil {
+            delay, backoff = probeInterval, minBackoff
+            continue
+        }
+        delay = backoff
+        if backoff *= 2; backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// setHealth applies the result of a probe
+func (d *dispatcher) setHealth(m *member, info *BackendInfo, err error) {
+    switch {
+    case err != nil && !m.unhealthy:
+        log.Printf("backend %s is unhealthy: %v", m.name, err)
+        m.unhealthy = true
+    case err == nil && m.unhealthy:
+        log.Printf("backend %s is healthy again", m.name)
+        m.unhealthy = false
+    }
+    if err != nil {
+        return
+    }
+    if info.Capacity != m.capacity {
+        log.Printf("backend %s has capacity %d", m.name, info.Capacity)
+        m.capacity = info.Capacity
+    }
+    // the backend counts the tasks of the queue too; a full backend is
+    // skipped until a probe finds a free slot
+    m.external = info.Busy - m.busy
+    if m.external < 0 {
+        m.external = 0
+    }
+}
+
+// do runs f in the dispatcher loop and waits for it
+func (d *dispatcher) do(f func()) {
+    done := make(chan void)
+    d.control <- func() {
+        defer close(done)
+        f()
+    }
+    <-done
+}
+
+// AddBackend adds a remote backend to the queue, or resumes assigning
+// tasks to it if it is draining.
+func (queue *Queue) AddBackend(addr string) error {
+    if addr == "" || addr == localName {
+        return reply.Error("Invalid backend address")
+    }
+    d := queue.dispatch
+    d.do(func() {
+        if m := d.find(addr); m != nil {
+            m.draining = false
+            return
+        }
+        m := newRemoteMember(addr)
+        d.members = append(d.members, m)
+        d.watch(m)
+    })
+    return nil
+}
+
+// DrainBackend stops assigning tasks to a remote backend, letting
+// the running tasks finish.
+func (queue *Queue) DrainBackend(addr string) error {
+    return queue.updateBackend(addr, func(m *member) {
+        m.draining = true
+    })
+}
+
+// RemoveBackend drains a remote backend and forgets it
+// as soon as it is not busy.
+func (queue *Queue) RemoveBackend(addr string) error {
+    d := queue.dispatch
+    return queue.updateBackend(addr, d.remove)
+}
+
+// remove drains the backend and forgets it as soon as it is not busy
+func (d *dispatcher) remove(m *member) {
+    m.draining = true
+    m.removed = true
+    if m.busy == 0 {
+        d.forget(m)
+    }
+}
+
+func (queue *Queue) updateBackend(addr string, f func(m *member)) error {
+    var err error
+    d := queue.dispatch
+    d.do(func() {
+        m := d.find(addr)
+        if m == nil || addr == localName {
+            err = reply.Error("Unknown backend")
+            return
+        }
+        f(m)
+    })
+    return err
+}
+
+// Backends returns the status of all backends of the queue.
+func (queue *Queue) Backends() []BackendStatus {
+    var statuses []BackendStatus
+    d := queue.dispatch
+    d.do(func() {
+        statuses = make([]BackendStatus, 0, len(d.members))
+        for _, m := range d.members {
+            if m.removed {
+                continue
+            }
+            statuses = append(statuses, BackendStatus{
+                Addr:     m.name,
+                Capacity: m.capacity,
+                Busy:     m.busy,
+                Draining: m.draining,
+                Healthy:  !m.unhealthy,
+            })
+        }
+    })
+    return statuses
+}
@@ -0,0 +1,225 @@
+package queue
+
+import (
+    "math"
+    "sort"
+)
+
+// Policy decides the order in which waiting tasks start. The dispatcher
+// enforces the level limits of plan-queue.md, and asks the policy which
+// of the tasks the limits allow should start first. Methods are only
+// called by the dispatcher loop.
+type Policy interface {
+    // Enqueue adds a waiting task. A task whose backend could not take
+    // it comes back with retry set.
+    Enqueue(w Waiting, retry bool)
+    // Next returns the waiting task of at most maxLevel that should start
+    // first, or nil. The task keeps waiting until Start.
+    Next(maxLevel int) Waiting
+    // Start removes a task returned by Next, as it starts
+    Start(w Waiting)
+    // Withdraw removes a waiting task that stopped
+    Withdraw(w Waiting)
+    // Finish is called when a started task stops
+    Finish(w Waiting)
+    // Order returns the waiting tasks in the order they are expected
+    // to start; estimates and positions sent to clients follow it.
+    // The caller must not modify the slice.
+    Order() []Waiting
+}
+
+// Waiting is a task of the queue, as seen by a Policy. Its level and
+// duration may change while it waits, if the client resizes it, or if
+// its backend could not take it.
+type Waiting interface {
+    // level of the task, 0 for waiting "default" tasks
+    Level() int
+    // limit on duration of the task, seconds
+    Duration() float64
+    // identifies the client of the task, like its IP address
+    Client() string
+}
+
+// Policies holds the policies for Config.Policy by name
+var Policies = map[string]func() Policy{
+    "fifo":     func() Policy { return &fifoPolicy{} },
+    "shortest": func() Policy { return &shortestPolicy{} },
+    "fair":     func() Policy { return newFairPolicy() },
+}
+
+// newPolicy returns the policy of the given name, "fifo" by default
+func newPolicy(name string) Policy {
+    if name == "" {
+        name = "fifo"
+    }
+    return Policies[name]()
+}
+
+// fifoPolicy starts tasks in order of arrival. A task whose backend
+// could not take it returns to the front of the queue.
+type fifoPolicy struct {
+    taskList
+}
+
+func (p *fifoPolicy) Enqueue(w Waiting, retry bool) {
+    if retry {
+        p.pushFront(w)
+        return
+    }
+    p.push(w)
+}
+
+func (p *fifoPolicy) Next(maxLevel int) Waiting {
+    return p.first(maxLevel)
+}
+
+func (p *fifoPolicy) Start(w Waiting) {
+    p.remove(w)
+}
+
+func (p *fifoPolicy) Withdraw(w Waiting) {
+    p.remove(w)
+}
+
+func (p *fifoPolicy) Finish(w Waiting) {}
+
+func (p *fifoPolicy) Order() []Waiting {
+    return p.entries
+}
+
+// shortestPolicy starts tasks with the lowest limits on duration first,
+// in order of arrival among equal ones. Waiting "default" tasks have
+// the maximum duration, so they start last; slow tasks may starve
+// under a constant load of faster ones.
+type shortestPolicy struct {
+    fifoPolicy
+}
+
+func (p *shortestPolicy) Next(maxLevel int) Waiting {
+    var next Waiting
+    for _, w := range p.entries {
+        if w.Level() > maxLevel {
+            continue
+        }
+        if next == nil || w.Duration() < next.Duration() {
+            next = w
+        }
+    }
+    return next
+}
+
+func (p *shortestPolicy) Order() []Waiting {
+    order := append([]Waiting(nil), p.entries...)
+    sort.SliceStable(order, func(i, j int) bool {
+        return order[i].Duration() < order[j].Duration()
+    })
+    return order
+}
+
+// fairPolicy starts tasks of the clients that run the fewest tasks
+// first, then of those that were served least recently, in order of
+// arrival among tasks of a client, so that a client that sends many
+// tasks does not hold up the others.
+type fairPolicy struct {
+    fifoPolicy
+    clients map[string]*client
+    // number of started tasks
+    served uint64
+}
+
+// client is the state of a client that has running or waiting tasks
+type client struct {
+    running int
+    // value of served when a task of the client last started
+    served uint64
+}
+
+func newFairPolicy() *fairPolicy {
+    return &fairPolicy{clients: make(map[string]*client)}
+}
+
+func (p *fairPolicy) Enqueue(w Waiting, retry bool) {
+    if p.clients[w.Client()] == nil {
+        p.clients[w.Client()] = &client{}
+    }
+    p.fifoPolicy.Enqueue(w, retry)
+}
+
+func (p *fairPolicy) Next(maxLevel int) Waiting {
+    return pickFair(p.entries, maxLevel, p.clients)
+}
+
+// pickFair returns the first task of at most maxLevel of the client
+// that runs the fewest tasks and was served least recently
+func pickFair(entries []Waiting, maxLevel int, clients map[string]*client,
+) Waiting {
+    var next Waiting
+    var best *client
+    for _, w := range entries {
+        if w.Level() > maxLevel {
+            continue
+        }
+        c := clients[w.Client()]
+        if next == nil || c.running < best.running ||
+            c.running == best.running && c.served < best.served {
+            next, best = w, c
+        }
+    }
+    return next
+}
+
+func (p *fairPolicy) Start(w Waiting) {
+    p.remove(w)
+    p.served++
+    c := p.clients[w.Client()]
+    c.running++
+    c.served = p.served
+}
+
+func (p *fairPolicy) Withdraw(w Waiting) {
+    p.remove(w)
+    p.forget(w.Client())
+}
+
+func (p *fairPolicy) Finish(w Waiting) {
+    if c := p.clients[w.Client()]; c != nil {
+        c.running--
+        p.forget(w.Client())
+    }
+}
+
+// forget drops the state of a client without running or waiting tasks
+func (p *fairPolicy) forget(name string) {
+    if c := p.clients[name]; c == nil || c.running > 0 {
+        return
+    }
+    for _, w := range p.entries {
+        if w.Client() == name {
+            return
+        }
+    }
+    delete(p.clients, name)
+}
+
+// Order assumes that waiting tasks start one by one, and that running
+// tasks do not finish meanwhile
+func (p *fairPolicy) Order() []Waiting {
+    clients := make(map[string]*client, len(p.clients))
+    for name, c := range p.clients {
+        copied := *c
+        clients[name] = &copied
+    }
+    served := p.served
+    rest := taskList{append([]Waiting(nil), p.entries...)}
+    order := make([]Waiting, 0, rest.len())
+    for rest.len() > 0 {
+        w := pickFair(rest.entries, math.MaxInt, clients)
+        rest.remove(w)
+        served++
+        c := clients[w.Client()]
+        c.running++
+        c.served = served
+        order = append(order, w)
+    }
+    return order
+}
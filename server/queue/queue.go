@@ -1,36 +1,96 @@
 package queue
 
-const maxDuration float64 = 30
+import (
+    "github.com/redis/go-redis/v9"
+
+    "asyonline/server/server/results"
+)
+
+// Config holds settings of a queue.
+type Config struct {
+    // addresses of backends, like "localhost:8081"
+    Backends []string
+    // creates tasks that run in the same process, in addition to
+    // Backends; nil if there are none
+    Local func(conn LocalConn) (LocalTask, error)
+    // number of concurrent local tasks
+    LocalCapacity int
+    // upper limit on duration of tasks, seconds
+    MaxDuration float64
+    // tiers of tasks by duration, from the fastest, see plan-queue.md
+    Levels []Level
+    // address of the Redis server of a distributed queue, see
+    // plan-queue.md; empty to dispatch tasks in the same process
+    Redis string
+    // name of the scheduling policy in Policies, "fifo" if empty
+    Policy string
+    // outcomes of tasks that succeeded, replayed to identical tasks
+    // without queueing them; nil to queue every task
+    Results *results.Store
+}
+
+// Level is a tier of tasks by duration. A task belongs to the first
+// level whose Duration is not less than its own, or to the last level,
+// which extends up to MaxDuration.
+type Level struct {
+    // seconds
+    Duration float64
+    // share of backends that may run tasks of this level or slower ones,
+    // at least one backend; ignored for the first level
+    Share float64
+}
+
+func DefaultConfig() *Config {
+    return &Config{
+        Backends:    []string{"localhost:8081"},
+        MaxDuration: 30,
+        Levels:      []Level{{3, 1}, {10, 0.5}, {30, 0.25}},
+        Policy:      "fifo",
+    }
+}
 
 type Queue struct {
-    list     *taskList
-    backends *backendPool
+    config   *Config
+    dispatch *dispatcher
+    // nil unless the queue is on Redis
+    redis *redis.Client
+    // task connections of workers, see WorkerHandler
+    workerConns pendingConns
+    // identical tasks that are queued or running
+    flights *flights
 }
 
-func NewQueue(addrs []string) *Queue {
-    list := newTaskList(maxDuration)
-    backends := newBackendPool()
-    for _, addr := range addrs {
-        go func(addr string) {
-            backends.input <- &backend{addr}
-        }(addr)
+func NewQueue(config *Config) *Queue {
+    if config.Redis != "" {
+        // tasks are dispatched by Scheduler and run by Workers
+        return &Queue{
+            config:  config,
+            redis:   newRedis(config.Redis),
+            flights: newFlights(),
+        }
+    }
+    var members []*member
+    for _, addr := range config.Backends {
+        members = append(members, newRemoteMember(addr))
+    }
+    if config.Local != nil {
+        members = append(members, &member{
+            name:     localName,
+            backend:  &localBackend{config.Local},
+            capacity: config.LocalCapacity,
+        })
     }
     queue := &Queue{
-        list:     list,
-        backends: backends,
+        config:      config,
+        dispatch:    newDispatcher(config, members),
+        workerConns: newPendingConns(),
+        flights:     newFlights(),
     }
-    go dispatchLoop(list, backends, []QueueLevel{{maxDuration, len(addrs)}})
+    go queue.dispatch.loop()
     return queue
 }
 
 func (queue *Queue) NewTask(conn conn) (*Task, error) {
-    task := newTask(conn)
-    task.queue = queue
+    task := newTask(conn, queue)
     return task, nil
 }
-
-type QueueLevel = struct {
-    duration float64
-    limit    int
-}
-
@@ -0,0 +1,305 @@
+package queue
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "log"
+    "math"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+
+    "asyonline/server/server/message"
+    "asyonline/server/server/reply"
+)
+
+// keys of the Redis queue, see plan-queue.md
+const (
+    keyTaskCounter    = "task.counter"
+    keyIncoming       = "queue.incoming"
+    keyQueue          = "queue"
+    keyOutcoming      = "queue.outcoming"
+    keyProcessing     = "queue.processing"
+    keyFinished       = "queue.finished"
+    keyExecuting      = "queue.executing"
+    keyBackendCounter = "backend.counter"
+    keyBackendSet     = "backend.set"
+    keyBackendUpdated = "backend.updated"
+    // consumer group of backends reading queue.outcoming
+    groupBackends = "backend"
+)
+
+const (
+    // task and backend keys expire unless they are refreshed
+    taskTTL    time.Duration = 600e9 // 10min
+    backendTTL time.Duration = 600e9 // 10min
+    // keys are refreshed this often
+    heartbeatInterval time.Duration = 10e9 // 10s
+    // blocking commands time out this often, to notice stopped tasks
+    pollInterval time.Duration = 1e9 // 1s
+    // tasks that no backend takes from queue.outcoming in this time
+    // are aborted
+    pendingTimeout time.Duration = 60e9 // 1min
+    // the scheduler looks for aborted tasks and lost backends this often
+    monitorInterval time.Duration = 10e9 // 10s
+)
+
+// commands are never cancelled, blocking ones time out instead
+var ctx = context.Background()
+
+func taskKey(id string) string {
+    return "task:" + id
+}
+
+func filesKey(id string) string {
+    return "task:" + id + ":files"
+}
+
+func backendURLKey(id string) string {
+    return "task:" + id + ":backend"
+}
+
+func estimateKey(id string) string {
+    return "task:" + id + ":queue.estimate"
+}
+
+func backendKey(id string) string {
+    return "backend:" + id
+}
+
+func newRedis(addr string) *redis.Client {
+    return redis.NewClient(&redis.Options{Addr: addr})
+}
+
+// createGroup creates the consumer group of backends,
+// unless it already exists
+func createGroup(rdb *redis.Client) error {
+    err := rdb.XGroupCreateMkStream(ctx, keyOutcoming, groupBackends, "0").Err()
+    if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+        return err
+    }
+    return nil
+}
+
+// fields returns the options of the task for "task:ID" hash
+func (t *Task) fields() map[string]interface{} {
+    return map[string]interface{}{
+        "client":      t.client,
+        "main":        t.mainname,
+        "duration":    t.duration,
+        "fixed":       t.fixed,
+        "format":      t.format,
+        "stderrRedir": t.stderrRedir,
+        "verbosity":   t.verbosity,
+        "attempts":    t.attempts,
+    }
+}
+
+// taskOf restores a task from "task:ID" and "task:ID:files" hashes.
+// The task can only be passed to configure.
+func taskOf(fields, files map[string]string) (*Task, error) {
+    var err error
+    t := &Task{
+        sources:  make(map[string][]byte, len(files)),
+        mainname: fields["main"],
+        format:   fields["format"],
+    }
+    for filename, contents := range files {
+        t.sources[filename] = []byte(contents)
+    }
+    t.duration, err = strconv.ParseFloat(fields["duration"], 64)
+    if err != nil {
+        return nil, fmt.Errorf("task hash: %w", err)
+    }
+    t.fixed = fields["fixed"] == "1"
+    t.stderrRedir = fields["stderrRedir"] == "1"
+    t.verbosity, err = strconv.Atoi(fields["verbosity"])
+    if err != nil {
+        return nil, fmt.Errorf("task hash: %w", err)
+    }
+    return t, nil
+}
+
+// redisLoop passes the task through the Redis queue
+// to a Worker, see plan-queue.md
+func (t *Task) redisLoop() {
+    defer t.Stop()
+    for {
+        err := t.attempt()
+        if err == nil {
+            return
+        }
+        log.Print(err)
+        t.attempts++
+        if t.attempts >= maxAttempts {
+            t.conn.Deny(reply.Error("No backend is available, try later"))
+            return
+        }
+        // try another worker
+    }
+}
+
+// attempt queues the task under a new ID and relays it through the worker
+// that takes it. An error is returned if the worker could not be reached;
+// other errors deny the task.
+func (t *Task) attempt() error {
+    rdb := t.queue.redis
+    n, err := rdb.Incr(ctx, keyTaskCounter).Result()
+    if err != nil {
+        t.conn.Deny(err)
+        return nil
+    }
+    t.id = strconv.FormatInt(n, 10)
+    // the worker that could not be reached moves the ID to queue.finished
+    defer t.clear()
+    if err := t.push(); err != nil {
+        t.conn.Deny(err)
+        return nil
+    }
+    url, ok := t.waitBackend()
+    if !ok {
+        return nil
+    }
+    return t.relay(url)
+}
+
+// push stores the task and appends it to queue.incoming
+func (t *Task) push() error {
+    files := make(map[string]interface{}, len(t.sources))
+    for filename, contents := range t.sources {
+        files[filename] = contents
+    }
+    _, err := t.queue.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+        p.HSet(ctx, taskKey(t.id), t.fields())
+        p.Expire(ctx, taskKey(t.id), taskTTL)
+        if len(files) > 0 {
+            p.HSet(ctx, filesKey(t.id), files)
+            p.Expire(ctx, filesKey(t.id), taskTTL)
+        }
+        p.RPush(ctx, keyIncoming, t.id)
+        return nil
+    })
+    return err
+}
+
+// waitBackend waits for the URL of a backend, sending queue status
+// to the client and keeping the task keys from expiring meanwhile
+func (t *Task) waitBackend() (url string, ok bool) {
+    rdb := t.queue.redis
+    heartbeat := time.NewTicker(heartbeatInterval)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case <-t.Stopped:
+            return "", false
+        case <-heartbeat.C:
+            alive, err := t.touch(filesKey(t.id))
+            if err != nil {
+                log.Print(err)
+                break
+            }
+            if !alive {
+                // aborted by the scheduler
+                t.conn.Deny(reply.Error("The task was lost, try again"))
+                return "", false
+            }
+        default:
+        }
+        result, err := rdb.BLPop(ctx, pollInterval,
+            backendURLKey(t.id), estimateKey(t.id)).Result()
+        if errors.Is(err, redis.Nil) {
+            continue
+        }
+        if err != nil {
+            t.conn.Deny(err)
+            return "", false
+        }
+        if result[0] == backendURLKey(t.id) {
+            return result[1], true
+        }
+        var status message.QueueStatus
+        if err := json.Unmarshal([]byte(result[1]), &status); err != nil {
+            log.Print(err)
+            continue
+        }
+        if err := t.conn.SendStatus(&message.Status{Queue: &status}); err != nil {
+            log.Print(err)
+            return "", false
+        }
+    }
+}
+
+// touch delays "task:ID" and other given keys from expiring.
+// It reports whether "task:ID" still exists.
+func (t *Task) touch(keys ...string) (bool, error) {
+    var alive *redis.BoolCmd
+    _, err := t.queue.redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+        alive = p.Expire(ctx, taskKey(t.id), taskTTL)
+        for _, key := range keys {
+            p.Expire(ctx, key, taskTTL)
+        }
+        return nil
+    })
+    if err != nil {
+        return false, err
+    }
+    return alive.Val(), nil
+}
+
+// relay connects to the backend at url and passes its output
+// to the client, and duration updates to the backend. An error is
+// returned if the backend could not take the task.
+func (t *Task) relay(url string) error {
+    backconn, err := dial(url, nil)
+    if err != nil {
+        return err
+    }
+    defer backconn.Close()
+    t.backconn = backconn
+    received := make(chan error, 1)
+    go t.receive(received)
+    heartbeat := time.NewTicker(heartbeatInterval)
+    defer heartbeat.Stop()
+    for {
+        select {
+        case duration := <-t.durations:
+            if err := t.sendDuration(duration); err != nil {
+                log.Print(err)
+                return nil
+            }
+        case <-heartbeat.C:
+            if _, err := t.touch(); err != nil {
+                log.Print(err)
+            }
+        case err := <-received:
+            return err
+        case <-t.Stopped:
+            return nil
+        }
+    }
+}
+
+// clear deletes the keys of the task
+func (t *Task) clear() {
+    err := t.queue.redis.Del(ctx, taskKey(t.id), filesKey(t.id),
+        backendURLKey(t.id), estimateKey(t.id)).Err()
+    if err != nil {
+        log.Print(err)
+    }
+}
+
+// resize passes a duration requested by the client after the start
+// to the backend, keeping the lowest one until it is sent
+func (t *Task) resize(duration float64) {
+    // sync: server readloop, the only sender to durations
+    select {
+    case previous := <-t.durations:
+        duration = math.Min(duration, previous)
+    default:
+    }
+    t.durations <- duration
+}
@@ -0,0 +1,379 @@
+package queue
+
+import (
+    "io"
+    "net"
+    "net/http/httptest"
+    "os"
+    "os/exec"
+    "strconv"
+    "strings"
+    "sync"
+    "testing"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+)
+
+// startRedis returns the address of an empty Redis database: the one at
+// $REDIS_ADDR, or of a redis-server started on a free port. The test is
+// skipped if there is neither.
+func startRedis(tb testing.TB) string {
+    tb.Helper()
+    addr := os.Getenv("REDIS_ADDR")
+    if addr == "" {
+        path, err := exec.LookPath("redis-server")
+        if err != nil {
+            tb.Skip("neither REDIS_ADDR nor redis-server is available")
+        }
+        l, err := net.Listen("tcp", "127.0.0.1:0")
+        if err != nil {
+            tb.Fatal(err)
+        }
+        addr = l.Addr().String()
+        l.Close()
+        _, port, _ := net.SplitHostPort(addr)
+        cmd := exec.Command(path, "--bind", "127.0.0.1", "--port", port,
+            "--save", "", "--appendonly", "no")
+        if err := cmd.Start(); err != nil {
+            tb.Fatal(err)
+        }
+        tb.Cleanup(func() {
+            cmd.Process.Kill()
+            cmd.Wait()
+        })
+    }
+    rdb := newRedis(addr)
+    defer rdb.Close()
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        err := rdb.FlushAll(ctx).Err()
+        if err == nil {
+            return addr
+        }
+        if time.Now().After(deadline) {
+            tb.Fatal(err)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+// echoTask is a local task that outputs its main file
+type echoTask struct {
+    conn    LocalConn
+    sources map[string][]byte
+    once    sync.Once
+    done    chan void
+}
+
+func newEchoTask(conn LocalConn) (LocalTask, error) {
+    return &echoTask{
+        conn:    conn,
+        sources: make(map[string][]byte),
+        done:    make(chan void),
+    }, nil
+}
+
+func (t *echoTask) AddFile(filename string, contents []byte) error {
+    t.sources[filename] = contents
+    return nil
+}
+
+func (t *echoTask) SetDuration(duration float64) error    { return nil }
+func (t *echoTask) SetFormat(format string) error         { return nil }
+func (t *echoTask) SetStderrRedir(stderrRedir bool) error { return nil }
+func (t *echoTask) SetVerbosity(verbosity int) error      { return nil }
+
+func (t *echoTask) Start(mainname string) error {
+    go func() {
+        defer t.Stop()
+        if err := t.conn.SendOutput("stdout", nil); err != nil {
+            return
+        }
+        if err := t.conn.SendOutput("stdout", t.sources[mainname]); err != nil {
+            return
+        }
+        t.conn.Complete(nil)
+    }()
+    return nil
+}
+
+func (t *echoTask) Stop() {
+    t.once.Do(func() { close(t.done) })
+}
+
+func (t *echoTask) Done() <-chan void {
+    return t.done
+}
+
+// startWorker runs a worker of the queue at addr, at a local address
+// unless workerAddr is set
+func startWorker(tb testing.TB, addr, workerAddr string) {
+    tb.Helper()
+    w := NewWorker(&WorkerConfig{
+        Redis:    addr,
+        Addr:     workerAddr,
+        Capacity: 1,
+        NewTask:  newEchoTask,
+    })
+    if workerAddr == "" {
+        srv := httptest.NewServer(w.Handler())
+        tb.Cleanup(srv.Close)
+        w.config.Addr = strings.TrimPrefix(srv.URL, "http://")
+    }
+    done := make(chan void)
+    go func() {
+        defer close(done)
+        if err := w.Run(); err != nil {
+            tb.Error(err)
+        }
+    }()
+    tb.Cleanup(func() {
+        w.Shutdown()
+        <-done
+    })
+}
+
+// startScheduler runs the scheduler of the queue at addr
+func startScheduler(tb testing.TB, addr string) {
+    s := NewScheduler(&Config{Redis: addr, MaxDuration: 30})
+    done := make(chan void)
+    go func() {
+        defer close(done)
+        s.Run()
+    }()
+    tb.Cleanup(func() {
+        s.Shutdown()
+        <-done
+    })
+}
+
+// submit starts a task on the queue at addr, with main file source
+func submit(tb testing.TB, addr string, source string) *fakeConn {
+    tb.Helper()
+    queue := NewQueue(&Config{Redis: addr, MaxDuration: 30})
+    conn := &fakeConn{}
+    t, err := queue.NewTask(conn)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    if err := t.AddFile("main.asy", []byte(source)); err != nil {
+        tb.Fatal(err)
+    }
+    if err := t.Start("main.asy"); err != nil {
+        tb.Fatal(err)
+    }
+    tb.Cleanup(t.Stop)
+    return conn
+}
+
+// complete waits until the task of conn completes with output
+func complete(tb testing.TB, conn *fakeConn, output string) {
+    tb.Helper()
+    deadline := time.Now().Add(20 * time.Second)
+    for {
+        conn.mutex.Lock()
+        completed, failed, denied := conn.completed, conn.failed, conn.denied
+        got := string(conn.output)
+        conn.mutex.Unlock()
+        switch {
+        case denied != nil:
+            tb.Fatalf("denied: %v", denied)
+        case completed && failed != nil:
+            tb.Fatalf("failed: %v", failed)
+        case completed && got != output:
+            tb.Fatalf("output %q, expected %q", got, output)
+        case completed:
+            return
+        case time.Now().After(deadline):
+            tb.Fatal("the task did not complete")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestRedisQueue(t *testing.T) {
+    addr := startRedis(t)
+    startScheduler(t, addr)
+    startWorker(t, addr, "")
+    first := submit(t, addr, "first")
+    second := submit(t, addr, "second")
+    complete(t, first, "first")
+    complete(t, second, "second")
+    rdb := newRedis(addr)
+    defer rdb.Close()
+    // the worker moves finished tasks to queue.finished, and the
+    // scheduler forgets them
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        n, err := rdb.HLen(ctx, keyExecuting).Result()
+        if err != nil {
+            t.Fatal(err)
+        }
+        if n == 0 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("%d tasks are still executing", n)
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+}
+
+func TestRedisUnreachableWorker(t *testing.T) {
+    addr := startRedis(t)
+    startScheduler(t, addr)
+    // nothing listens at port 1
+    startWorker(t, addr, "127.0.0.1:1")
+    conn := submit(t, addr, "retried")
+    rdb := newRedis(addr)
+    defer rdb.Close()
+    // the task comes back under a new ID
+    deadline := time.Now().Add(10 * time.Second)
+    for {
+        n, err := rdb.Get(ctx, keyTaskCounter).Int()
+        if err != nil && err != redis.Nil {
+            t.Fatal(err)
+        }
+        if n >= 2 {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatal("the task was not queued again")
+        }
+        time.Sleep(10 * time.Millisecond)
+    }
+    attempts, err := rdb.HGet(ctx, taskKey("2"), "attempts").Result()
+    if err != nil || attempts != "1" {
+        t.Errorf("attempts %q (%v), expected 1", attempts, err)
+    }
+    startWorker(t, addr, "")
+    complete(t, conn, "retried")
+}
+
+// proxy passes connections to a Redis server, and can drop them
+type proxy struct {
+    listener net.Listener
+    target   string
+    mutex    sync.Mutex
+    conns    []net.Conn
+    down     bool
+}
+
+func startProxy(tb testing.TB, target string) *proxy {
+    l, err := net.Listen("tcp", "127.0.0.1:0")
+    if err != nil {
+        tb.Fatal(err)
+    }
+    p := &proxy{listener: l, target: target}
+    tb.Cleanup(func() {
+        l.Close()
+        p.setDown(true)
+    })
+    go p.acceptLoop()
+    return p
+}
+
+func (p *proxy) addr() string {
+    return p.listener.Addr().String()
+}
+
+func (p *proxy) acceptLoop() {
+    for {
+        conn, err := p.listener.Accept()
+        if err != nil {
+            return
+        }
+        p.mutex.Lock()
+        down := p.down
+        if !down {
+            p.conns = append(p.conns, conn)
+        }
+        p.mutex.Unlock()
+        if down {
+            conn.Close()
+            continue
+        }
+        go p.pass(conn)
+    }
+}
+
+func (p *proxy) pass(conn net.Conn) {
+    defer conn.Close()
+    upstream, err := net.Dial("tcp", p.target)
+    if err != nil {
+        return
+    }
+    defer upstream.Close()
+    go io.Copy(upstream, conn)
+    io.Copy(conn, upstream)
+}
+
+// setDown drops connections and refuses new ones, or accepts them again
+func (p *proxy) setDown(down bool) {
+    p.mutex.Lock()
+    defer p.mutex.Unlock()
+    p.down = down
+    if down {
+        for _, conn := range p.conns {
+            conn.Close()
+        }
+        p.conns = nil
+    }
+}
+
+func TestSchedulerRecovers(t *testing.T) {
+    addr := startRedis(t)
+    p := startProxy(t, addr)
+    startScheduler(t, p.addr())
+    startWorker(t, addr, "")
+    complete(t, submit(t, addr, "before"), "before")
+    // longer than the retries of the Redis client
+    p.setDown(true)
+    time.Sleep(2 * time.Second)
+    p.setDown(false)
+    complete(t, submit(t, addr, "after"), "after")
+}
+
+func TestTaskFields(t *testing.T) {
+    task := &Task{
+        sources:     map[string][]byte{"main.asy": []byte("draw((0,0));")},
+        mainname:    "main.asy",
+        duration:    2.5,
+        fixed:       true,
+        format:      "svg",
+        stderrRedir: true,
+        verbosity:   2,
+    }
+    fields := make(map[string]string)
+    for key, value := range task.fields() {
+        switch value := value.(type) {
+        case bool:
+            // as stored by Redis
+            fields[key] = "0"
+            if value {
+                fields[key] = "1"
+            }
+        case float64:
+            fields[key] = strconv.FormatFloat(value, 'g', -1, 64)
+        case int:
+            fields[key] = strconv.Itoa(value)
+        case string:
+            fields[key] = value
+        }
+    }
+    files := map[string]string{"main.asy": "draw((0,0));"}
+    restored, err := taskOf(fields, files)
+    if err != nil {
+        t.Fatal(err)
+    }
+    if restored.mainname != task.mainname ||
+        restored.duration != task.duration ||
+        restored.fixed != task.fixed ||
+        restored.format != task.format ||
+        restored.stderrRedir != task.stderrRedir ||
+        restored.verbosity != task.verbosity ||
+        string(restored.sources["main.asy"]) != "draw((0,0));" {
+        t.Errorf("restored %+v, expected %+v", restored, task)
+    }
+}
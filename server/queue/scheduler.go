@@ -0,0 +1,414 @@
+package queue
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "math"
+    "strconv"
+    "sync"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+
+    "asyonline/server/server/message"
+)
+
+// Scheduler assigns tasks of the Redis queue to Workers, following
+// the limits of levels, see plan-queue.md. Only one scheduler may run
+// for a Redis server.
+type Scheduler struct {
+    config *Config
+    redis  *redis.Client
+    // the dispatcher keeps the state of the queue, but its loop does not
+    // run; tasks are only known by their IDs, and members are backends
+    // of the Redis queue
+    d     *dispatcher
+    tasks map[string]*Task
+    // score of the last task of the "queue" zset
+    score    float64
+    stopping chan void
+    stopOnce sync.Once
+}
+
+func NewScheduler(config *Config) *Scheduler {
+    return &Scheduler{
+        config:   config,
+        redis:    newRedis(config.Redis),
+        stopping: make(chan void),
+    }
+}
+
+// Run schedules tasks until Shutdown. On Redis errors, the state is
+// restored from Redis again, backing off exponentially while the errors
+// persist.
+func (s *Scheduler) Run() {
+    backoff := minBackoff
+    for {
+        started := time.Now()
+        err := s.run()
+        if err == nil {
+            return
+        }
+        log.Printf("scheduler: %v", err)
+        if time.Since(started) >= maxBackoff {
+            // it ran for a while, this is a new failure
+            backoff = minBackoff
+        }
+        select {
+        case <-time.After(backoff):
+        case <-s.stopping:
+            return
+        }
+        if backoff *= 2; backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// Shutdown stops Run
+func (s *Scheduler) Shutdown() {
+    s.stopOnce.Do(func() { close(s.stopping) })
+}
+
+// run restores the state and schedules tasks, returning on the first
+// Redis error, or with nil on Shutdown
+func (s *Scheduler) run() error {
+    s.d = newDispatcher(s.config, nil)
+    s.tasks = make(map[string]*Task)
+    s.score = 0
+    if err := s.restore(); err != nil {
+        return err
+    }
+    var monitored time.Time
+    for {
+        select {
+        case <-s.stopping:
+            return nil
+        default:
+        }
+        if time.Since(monitored) >= monitorInterval {
+            if err := s.monitor(); err != nil {
+                return err
+            }
+            monitored = time.Now()
+        }
+        result, err := s.redis.BLPop(ctx, pollInterval,
+            keyIncoming, keyFinished, keyBackendUpdated).Result()
+        switch {
+        case errors.Is(err, redis.Nil):
+            err = nil
+        case err != nil:
+        case result[0] == keyIncoming:
+            err = s.incoming(result[1])
+        case result[0] == keyFinished:
+            err = s.finished(result[1])
+        case result[0] == keyBackendUpdated:
+            err = s.updateBackends()
+        }
+        if err != nil {
+            return err
+        }
+        if err := s.dispatch(); err != nil {
+            return err
+        }
+        if err := s.sendStatuses(); err != nil {
+            return err
+        }
+    }
+}
+
+// restore loads the state left by a previous scheduler
+func (s *Scheduler) restore() error {
+    if err := createGroup(s.redis); err != nil {
+        return err
+    }
+    executing, err := s.redis.HGetAll(ctx, keyExecuting).Result()
+    if err != nil {
+        return err
+    }
+    for id, value := range executing {
+        duration, err := strconv.ParseFloat(value, 64)
+        if err != nil {
+            log.Printf("queue.executing: task %s: %v", id, err)
+            continue
+        }
+        // tasks that are gone are found by monitor
+        t := &Task{id: id}
+        s.tasks[id] = t
+        s.d.running[t] = &entry{
+            task:     t,
+            duration: duration,
+            level:    s.d.levelOf(duration),
+            fixed:    true,
+            started:  time.Now(),
+        }
+    }
+    waiting, err := s.redis.ZRangeWithScores(ctx, keyQueue, 0, -1).Result()
+    if err != nil {
+        return err
+    }
+    for _, z := range waiting {
+        id, _ := z.Member.(string)
+        s.score = z.Score
+        e, err := s.load(id)
+        if err != nil {
+            return err
+        }
+        if e == nil {
+            if err := s.redis.ZRem(ctx, keyQueue, id).Err(); err != nil {
+                return err
+            }
+            continue
+        }
+        s.d.push(e, false)
+    }
+    return s.updateBackends()
+}
+
+// load reads the duration of a task; the entry is nil if the task
+// is gone
+func (s *Scheduler) load(id string) (*entry, error) {
+    values, err := s.redis.HMGet(ctx, taskKey(id), "duration", "fixed",
+        "client", "attempts").Result()
+    if err != nil {
+        return nil, err
+    }
+    durationS, _ := values[0].(string)
+    fixedS, _ := values[1].(string)
+    client, _ := values[2].(string)
+    attemptsS, _ := values[3].(string)
+    if durationS == "" {
+        return nil, nil
+    }
+    duration, err := strconv.ParseFloat(durationS, 64)
+    if err != nil {
+        log.Printf("task %s: %v", id, err)
+        return nil, nil
+    }
+    t := &Task{id: id, client: client}
+    s.tasks[id] = t
+    attempts, _ := strconv.Atoi(attemptsS)
+    e := &entry{
+        task:     t,
+        duration: math.Min(duration, s.d.maxDuration),
+        fixed:    fixedS == "1",
+        attempts: attempts,
+    }
+    if e.fixed {
+        e.level = s.d.levelOf(e.duration)
+    }
+    return e, nil
+}
+
+// incoming appends a task to the queue. A task whose worker could not
+// be reached comes back under a new ID, and goes to the front.
+func (s *Scheduler) incoming(id string) error {
+    e, err := s.load(id)
+    if err != nil || e == nil {
+        return err
+    }
+    retry := e.attempts > 0
+    var score float64
+    if retry {
+        first, err := s.redis.ZRangeWithScores(ctx, keyQueue, 0, 0).Result()
+        if err != nil {
+            return err
+        }
+        score = s.score
+        if len(first) > 0 {
+            score = first[0].Score
+        }
+        score--
+    } else {
+        s.score++
+        score = s.score
+    }
+    err = s.redis.ZAdd(ctx, keyQueue,
+        redis.Z{Score: score, Member: id}).Err()
+    if err != nil {
+        return err
+    }
+    s.d.push(e, retry)
+    return nil
+}
+
+func (s *Scheduler) finished(id string) error {
+    if t, ok := s.tasks[id]; ok {
+        delete(s.tasks, id)
+        if e, ok := s.d.running[t]; ok {
+            s.d.finish(e)
+        }
+    }
+    return s.redis.HDel(ctx, keyExecuting, id).Err()
+}
+
+// dispatch moves tasks from the queue to queue.outcoming while there are
+// free backends. Tasks of levels that reached their limits are skipped.
+// Unlike dispatcher.dispatchOne, running tasks are never downgraded,
+// since workers do not accept new durations from the scheduler.
+func (s *Scheduler) dispatch() error {
+    d := s.d
+    for len(d.running) < d.total() {
+        e := s.next()
+        if e == nil {
+            return nil
+        }
+        // the state is restored from Redis after errors
+        d.start(e)
+        id := e.task.id
+        _, err := s.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+            p.ZRem(ctx, keyQueue, id)
+            p.HSet(ctx, keyExecuting, id, e.duration)
+            p.XAdd(ctx, &redis.XAddArgs{
+                Stream: keyOutcoming,
+                Values: map[string]interface{}{
+                    "task":     id,
+                    "duration": e.duration,
+                },
+            })
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// next returns the waiting task that can start first, or nil.
+// A task can start if its level has not reached its limit, nor have
+// the levels below it.
+func (s *Scheduler) next() *entry {
+    return s.d.next(s.d.allowedLevel(len(s.d.levels) - 1))
+}
+
+// sendStatuses replaces "task:ID:queue.estimate" of waiting tasks
+// whose status changed
+func (s *Scheduler) sendStatuses() error {
+    p := s.redis.TxPipeline()
+    s.d.updateStatuses(func(e *entry, status message.QueueStatus) {
+        statusB, err := json.Marshal(status)
+        if err != nil {
+            log.Print(err)
+            return
+        }
+        key := estimateKey(e.task.id)
+        p.Del(ctx, key)
+        p.RPush(ctx, key, statusB)
+        p.Expire(ctx, key, taskTTL)
+    })
+    _, err := p.Exec(ctx)
+    return err
+}
+
+// monitor aborts tasks that no backend took in time, and forgets tasks
+// and backends whose keys expired
+func (s *Scheduler) monitor() error {
+    stale, err := s.redis.XRange(ctx, keyOutcoming, "-", strconv.FormatInt(
+        time.Now().Add(-pendingTimeout).UnixMilli(), 10)).Result()
+    if err != nil {
+        return err
+    }
+    for _, msg := range stale {
+        id, _ := msg.Values["task"].(string)
+        log.Printf("task %s was not taken by a backend", id)
+        _, err := s.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+            p.XAck(ctx, keyOutcoming, groupBackends, msg.ID)
+            p.XDel(ctx, keyOutcoming, msg.ID)
+            // the frontend will deny the task
+            p.Del(ctx, taskKey(id))
+            return nil
+        })
+        if err != nil {
+            return err
+        }
+        if err := s.finished(id); err != nil {
+            return err
+        }
+    }
+    var running, waiting []*Task
+    for t := range s.d.running {
+        running = append(running, t)
+    }
+    for t := range s.d.waiting {
+        waiting = append(waiting, t)
+    }
+    gone, err := s.gone(running)
+    if err != nil {
+        return err
+    }
+    for _, t := range gone {
+        if err := s.redis.SRem(ctx, keyProcessing, t.id).Err(); err != nil {
+            return err
+        }
+        if err := s.finished(t.id); err != nil {
+            return err
+        }
+    }
+    gone, err = s.gone(waiting)
+    if err != nil {
+        return err
+    }
+    for _, t := range gone {
+        if err := s.redis.ZRem(ctx, keyQueue, t.id).Err(); err != nil {
+            return err
+        }
+        delete(s.tasks, t.id)
+        s.d.unqueue(s.d.waiting[t])
+    }
+    return s.updateBackends()
+}
+
+// gone returns the tasks whose "task:ID" keys do not exist
+func (s *Scheduler) gone(tasks []*Task) ([]*Task, error) {
+    exists := make([]*redis.IntCmd, len(tasks))
+    _, err := s.redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+        for i, t := range tasks {
+            exists[i] = p.Exists(ctx, taskKey(t.id))
+        }
+        return nil
+    })
+    if err != nil {
+        return nil, err
+    }
+    var gone []*Task
+    for i, t := range tasks {
+        if exists[i].Val() == 0 {
+            gone = append(gone, t)
+        }
+    }
+    return gone, nil
+}
+
+// updateBackends forgets backends whose keys expired,
+// and makes the rest members of the dispatcher
+func (s *Scheduler) updateBackends() error {
+    ids, err := s.redis.SMembers(ctx, keyBackendSet).Result()
+    if err != nil {
+        return err
+    }
+    exists := make([]*redis.IntCmd, len(ids))
+    _, err = s.redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+        for i, id := range ids {
+            exists[i] = p.Exists(ctx, backendKey(id))
+        }
+        return nil
+    })
+    if err != nil {
+        return err
+    }
+    members := make([]*member, 0, len(ids))
+    for i, id := range ids {
+        if exists[i].Val() == 0 {
+            log.Printf("backend %s is lost", id)
+            if err := s.redis.SRem(ctx, keyBackendSet, id).Err(); err != nil {
+                return err
+            }
+            continue
+        }
+        members = append(members, &member{name: id, capacity: 1})
+    }
+    s.d.members = members
+    return nil
+}
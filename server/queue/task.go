@@ -1,23 +1,25 @@
 package queue
 
 import (
-    "encoding/json"
     "errors"
     "io"
     "log"
-    "strings"
 
     "golang.org/x/net/websocket"
 
     "asyonline/server/common/stopper"
+    "asyonline/server/server/message"
     "asyonline/server/server/reply"
+    "asyonline/server/server/results"
 )
 
 type conn interface {
     //Stop()
+    Client() string
     Deny(err error)
     SendOutput(stream string, output []byte) error
     SendResult(format string, contents []byte) error
+    SendStatus(status *message.Status) error
     Complete(err error) error
 }
 
@@ -25,27 +27,44 @@ type Task struct {
     stopper.Stopper
     queue *Queue
     conn  conn
+    // identifies the client for the scheduling policy
+    client string
 
     // these must not change after started becomes true
     sources     map[string][]byte
     mainname    string
     duration    float64
+    fixed       bool // duration was set by the client
     format      string
     stderrRedir bool
     verbosity   int
 
-    started   bool
-    backconn  *websocket.Conn
-    durations chan<- float64
-    backends  chan<- *backend
+    started bool
+    // flight that the task subscribes to, see flights.join
+    flight   *flight
+    backconn *websocket.Conn
+    // ID of the task in the Redis queue, see redisLoop
+    id string
+    // number of workers that could not be reached, see redisLoop
+    attempts int
+    // sent by the dispatcher
+    assigned  chan assignment
+    durations chan float64
+    statuses  chan message.QueueStatus
 }
 
-func newTask(conn conn) *Task {
+func newTask(conn conn, queue *Queue) *Task {
     return &Task{
+        queue:    queue,
         conn:     conn,
+        client:   conn.Client(),
         sources:  make(map[string][]byte),
-        duration: maxDuration,
+        duration: queue.config.MaxDuration,
         Stopper:  stopper.New(),
+        // the dispatcher must never block on these
+        assigned:  make(chan assignment, 1),
+        durations: make(chan float64, 1),
+        statuses:  make(chan message.QueueStatus, 1),
     }
 }
 
@@ -61,17 +80,27 @@ func (t *Task) AddFile(filename string, contents []byte) error {
 
 func (t *Task) SetDuration(duration float64) error {
     // sync: server readloop
+    maxDuration := t.queue.config.MaxDuration
     if duration < 0 || duration > maxDuration {
         duration = maxDuration
     }
     if t.started {
+        if t.flight != nil {
+            t.flight.resize(t, duration)
+            return nil
+        }
+        if t.queue.redis != nil {
+            t.resize(duration)
+            return nil
+        }
         select {
-        case t.durations <- duration:
+        case t.queue.dispatch.resize <- resize{t, duration}:
         case <-t.Stopped:
         }
         return nil
     }
     t.duration = duration
+    t.fixed = true
     return nil
 }
 
@@ -108,269 +137,237 @@ func (t *Task) Start(mainname string) error {
         return reply.Error("The t has already started, cannot start again")
     }
     t.mainname = mainname
-    var durations = make(chan float64)
-    t.durations = durations
     t.started = true
     if t.duration == 0 {
         t.Stop()
         return nil
     }
-    go t.loop(durations)
+    var key string
+    if store := t.queue.config.Results; store != nil {
+        key = store.Key(t.sources, t.mainname,
+            t.format, t.verbosity, t.stderrRedir)
+        if outcome, ok := store.Load(key); ok {
+            go t.replay(outcome)
+            return nil
+        }
+    }
+    if shared := t.queue.flights.join(t); shared != nil {
+        shared.launch(key)
+    }
     return nil
 }
 
-func (t *Task) proceedWith(b *backend) {
-    t.backends <- b
-    close(t.backends)
-}
-
-func (t *Task) loop(durations <-chan float64) {
-    defer t.Stop()
-    var duration float64 = t.duration
-    var backends <-chan *backend
-    {
-        var backendsRS = make(chan *backend)
-        backends = backendsRS
-        t.backends = backendsRS
+// launch queues a task that runs for a flight, keeping its outcome under
+// key in the store of results
+func (t *Task) launch(key string) {
+    if store := t.queue.config.Results; store != nil {
+        t.conn = recordingConn{t.conn, results.NewRecorder(t.conn, store, key)}
+    }
+    if t.queue.redis != nil {
+        go t.redisLoop()
+        return
     }
     select {
-    case t.queue.list.input <- t:
+    case t.queue.dispatch.enqueue <- t:
     case <-t.Stopped:
         return
     }
+    go t.loop()
+}
 
-    var b *backend
+// replay sends the outcome of an identical task to the client
+// instead of queueing the task
+func (t *Task) replay(outcome *results.Outcome) {
+    defer t.Stop()
+    if err := outcome.Replay(t.conn); err != nil {
+        log.Print(err)
+    }
+}
+
+// recordingConn keeps the outcome of a task in the store of results
+type recordingConn struct {
+    conn
+    recorder *results.Recorder
+}
+
+func (c recordingConn) SendOutput(stream string, output []byte) error {
+    return c.recorder.SendOutput(stream, output)
+}
+
+func (c recordingConn) SendResult(format string, contents []byte) error {
+    return c.recorder.SendResult(format, contents)
+}
+
+func (c recordingConn) Complete(err error) error {
+    return c.recorder.Complete(err)
+}
+
+func (t *Task) loop() {
+    defer t.Stop()
     for {
-        select {
-        case newDuration := <-durations:
-            if newDuration < duration {
-                duration = newDuration
-            }
-            continue
-        case b = <-backends:
-        case <-t.Stopped:
+        a, ok := t.wait()
+        if !ok {
             return
         }
-        break
-    }
-
-    var err error
-    backconn, err := b.Dial()
-    if err != nil {
-        log.Print(err)
-        return
-    }
-    defer backconn.Close()
-    t.backconn = backconn
-    go t.receiveLoop()
-    err = t.sendStart(duration)
-    if err != nil {
+        if a.backend == nil {
+            t.conn.Deny(reply.Error("No backend is available, try later"))
+            return
+        }
+        err := a.backend.run(t, a.duration, t.durations)
+        if err == nil {
+            return
+        }
+        if errors.Is(err, errBackendBusy) {
+            // try another backend, or this one when it has a free slot
+            t.queue.dispatch.full <- t
+            continue
+        }
         log.Print(err)
-        return
+        // try another backend
+        t.queue.dispatch.requeue <- t
     }
+}
+
+// wait waits for a backend to be assigned, sending queue status
+// to the client meanwhile
+func (t *Task) wait() (a assignment, ok bool) {
     for {
         select {
-        case newDuration := <-durations:
-            if newDuration < duration {
-                duration = newDuration
-            }
-            err := t.sendDuration(duration)
+        case status := <-t.statuses:
+            err := t.conn.SendStatus(&message.Status{Queue: &status})
             if err != nil {
                 log.Print(err)
-                return
+                t.Stop()
+                t.queue.dispatch.withdraw <- t
+                return a, false
             }
+            continue
+        case a = <-t.assigned:
         case <-t.Stopped:
-            return
+            t.queue.dispatch.withdraw <- t
+            return a, false
         }
+        break
+    }
+    select {
+    case <-t.Stopped:
+        // stopped as it was assigned, the backend is returned anyway
+        return a, false
+    default:
     }
+    return a, true
 }
 
 func (task *Task) sendStart(duration float64) error {
     // sync: task loop
-    // send files
-    for filename, contents := range task.sources {
-        var err error
-        addArgsB, err := json.Marshal(struct {
-            Filename string `json:"filename"`
-        }{
-            Filename: filename,
-        })
-        if err != nil {
-            return err
-        }
-        addMsg := "add " + string(addArgsB)
-        err = websocket.Message.Send(task.backconn, addMsg)
-        if err != nil {
-            return err
-        }
-        err = websocket.Message.Send(task.backconn, contents)
-        if err != nil {
-            return err
-        }
+    var msg = message.Message{
+        Input: make([]message.Input, 0, len(task.sources)),
+        Options: &message.Options{
+            Duration:    &duration,
+            StderrRedir: &task.stderrRedir,
+            Verbosity:   &task.verbosity,
+        },
+        Start: &message.Start{Main: &task.mainname},
     }
-    { // send options
-        var err error
-        optionsArgsB, err := json.Marshal(struct {
-            Duration    float64 `json:"duration"`
-            Format      string  `json:"format"`
-            StderrRedir bool    `json:"stderrRedir"`
-            Verbosity   int     `json:"verbosity"`
-        }{
-            Duration:    duration,
-            Format:      task.format,
-            StderrRedir: task.stderrRedir,
-            Verbosity:   task.verbosity,
-        })
-        if err != nil {
-            return err
-        }
-        optionsMsg := "options " + string(optionsArgsB)
-        err = websocket.Message.Send(task.backconn, optionsMsg)
-        if err != nil {
-            return err
-        }
+    if task.format != "" {
+        msg.Options.Format = &task.format
     }
-    { // send start
-        var err error
-        startArgsB, err := json.Marshal(struct {
-            Main string `json:"main"`
-        }{
-            Main: task.mainname,
+    var blobs = make([][]byte, 0, len(task.sources))
+    for filename, contents := range task.sources {
+        filename := filename
+        msg.Input = append(msg.Input, message.Input{
+            Filename: &filename,
+            Blob:     message.Blob(len(blobs)),
         })
-        if err != nil {
-            return err
-        }
-        startMsg := "start " + string(startArgsB)
-        err = websocket.Message.Send(task.backconn, startMsg)
-        if err != nil {
-            return err
-        }
+        blobs = append(blobs, contents)
     }
-    return nil
+    return message.Send(task.backconn, &msg, blobs...)
 }
 
 func (task *Task) sendDuration(duration float64) error {
     // sync: task loop
-    var err error
-    optionsArgsB, err := json.Marshal(struct {
-        Duration float64 `json:"duration"`
-    }{
-        Duration: duration,
+    return message.Send(task.backconn, &message.Message{
+        Options: &message.Options{Duration: &duration},
     })
-    if err != nil {
-        return err
-    }
-    optionsMsg := "options " + string(optionsArgsB)
-    err = websocket.Message.Send(task.backconn, optionsMsg)
-    if err != nil {
-        return err
-    }
-    return nil
 }
 
-func (task *Task) receiveLoop() {
-    defer task.Stop()
+// errBackendBusy is returned by receiveLoop if the backend denied the task
+// for lack of capacity, so that another backend takes it
+var errBackendBusy = errors.New("backend is busy")
+
+// receive runs receiveLoop and sends its error to received. The task
+// is stopped when receiveLoop returns, unless the backend was busy.
+func (task *Task) receive(received chan<- error) {
+    err := task.receiveLoop()
+    if err == nil {
+        task.Stop()
+    }
+    received <- err
+}
 
-    const (
-        resultPrefix   = "result "
-        outputPrefix   = "output "
-        completePrefix = "complete "
-        denyPrefix     = "deny "
-    )
+// receiveLoop passes messages of the backend to the client
+// until the task ends
+func (task *Task) receiveLoop() error {
+    // backend sends an (empty) output when the process starts,
+    // errors before that are denials
+    var started bool = false
 
     for {
-        var message string
-        err := websocket.Message.Receive(task.backconn, &message)
+        msg, blobs, err := message.Receive(task.backconn)
         if err != nil {
             if errors.Is(err, io.EOF) {
-                return
+                return nil
             }
             select {
             case <-task.Stopped:
             default:
                 log.Println("backend websocket receive:", err)
             }
-            return
+            return nil
         }
-        switch {
-        case strings.HasPrefix(message, outputPrefix):
+        for _, output := range msg.Output {
             var err error
-            var outputArgs struct {
-                Stream string
+            if output.Blob == nil {
+                log.Print("backend websocket receive: 'output' without 'blob'")
+                return nil
             }
-            err = json.Unmarshal(
-                []byte(message[len(outputPrefix):]), &outputArgs)
-            if err != nil {
-                log.Println("'output' arguments are not a correct JSON:", err)
-                return
-            }
-            var contents []byte
-            err = websocket.Message.Receive(task.backconn, &contents)
-            if err != nil {
-                log.Print(err)
-                return
+            contents := blobs[*output.Blob]
+            switch {
+            case output.Stream != "":
+                err = task.conn.SendOutput(output.Stream, contents)
+            case output.Format != "":
+                err = task.conn.SendResult(output.Format, contents)
+            default:
+                log.Print("backend websocket receive: unknown 'output'")
+                return nil
             }
-            err = task.conn.SendOutput(outputArgs.Stream, contents)
             if err != nil {
                 log.Print(err)
-                return
-            }
-        case strings.HasPrefix(message, resultPrefix):
-            var err error
-            var resultArgs struct {
-                Format string
+                return nil
             }
-            err = json.Unmarshal(
-                []byte(message[len(resultPrefix):]), &resultArgs)
-            if err != nil {
-                log.Println("'result' arguments are not a correct JSON:", err)
-                return
-            }
-            var contents []byte
-            err = websocket.Message.Receive(task.backconn, &contents)
-            if err != nil {
-                log.Print(err)
-                return
+            started = true
+        }
+        switch {
+        case msg.Missing != nil:
+            log.Print("backend websocket receive: unexpected 'missing'")
+            return nil
+        case msg.Error != nil:
+            if !started {
+                if msg.Busy != nil {
+                    return errBackendBusy
+                }
+                task.conn.Deny(reply.Error(*msg.Error))
+                return nil
             }
-            err = task.conn.SendResult(resultArgs.Format, contents)
-            if err != nil {
+            if err := task.conn.Complete(reply.Error(*msg.Error)); err != nil {
                 log.Print(err)
-                return
-            }
-        case strings.HasPrefix(message, completePrefix):
-            var completeArgs struct {
-                Error *string
-            }
-            if err := json.Unmarshal(
-                []byte(message[len(completePrefix):]), &completeArgs,
-            ); err != nil {
-                log.Println("'complete' arguments are not a correct JSON:", err)
-                return
             }
-            var completeErr error = nil
-            if completeArgs.Error != nil {
-                completeErr = reply.Error(*completeArgs.Error)
-            }
-            if err := task.conn.Complete(completeErr); err != nil {
+            return nil
+        case msg.Ok != 0:
+            if err := task.conn.Complete(nil); err != nil {
                 log.Print(err)
-                return
-            }
-            return
-        case strings.HasPrefix(message, denyPrefix):
-            var denyArgs struct {
-                Error string
             }
-            if err := json.Unmarshal(
-                []byte(message[len(denyPrefix):]), &denyArgs,
-            ); err != nil {
-                log.Println("'deny' arguments are not a correct JSON:", err)
-                return
-            }
-            task.conn.Deny(reply.Error(denyArgs.Error))
-            return
-        default:
-            log.Print("backend websocket receive: unknown command")
-            return
+            return nil
         }
     }
 }
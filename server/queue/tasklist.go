@@ -1,105 +1,79 @@
 package queue
 
+import (
+    "time"
+
+    "asyonline/server/server/message"
+)
+
+// entry is the dispatcher's record of a task
+type entry struct {
+    task *Task
+    // current limit on duration, seconds
+    duration float64
+    level    int
+    // false for "default" tasks, whose duration was not requested
+    // by the client and may be downgraded
+    fixed bool
+    // backend that runs the task, if started
+    member  *member
+    started time.Time
+    // number of backends that could not take the task
+    attempts int
+    // a goroutine reports the task as finished when it stops
+    watched bool
+    // last status sent to the waiting task
+    sent   *message.QueueStatus
+    sentAt time.Time
+}
+
+func (e *entry) Level() int {
+    return e.level
+}
+
+func (e *entry) Duration() float64 {
+    return e.duration
+}
+
+func (e *entry) Client() string {
+    return e.task.client
+}
+
+// taskList holds waiting tasks in order of arrival
 type taskList struct {
-    input   chan<- *Task
-    filters chan<- float64
-    output  <-chan *Task
-    // input and filters channels will block if output is clogged
+    entries []Waiting
 }
 
-func newTaskList(maxDuration float64) *taskList {
-    var (
-        input   = make(chan *Task)
-        filters = make(chan float64)
-        output  = make(chan *Task)
-    )
-    go func(
-        input <-chan *Task,
-        filters <-chan float64,
-        output chan<- *Task,
-    ) {
-        defer close(output)
-        type (
-            taskListItem = struct {
-                task     *Task
-                duration float64
-            }
-            taskListSlice = struct {
-                duration float64
-                offset   int
-            }
-        )
-        var (
-            tasks          = []taskListItem{}
-            offset int    = 0
-            slices         = []taskListSlice{{maxDuration, 0}}
-            i      int     = len(slices)
-            filter float64 = 0.0
-        )
-        for {
-            select {
-            case task, ok := <-input:
-                if !ok {
-                    return
-                }
-                duration := task.duration
-                if duration <= 0 || duration > maxDuration {
-                    duration = maxDuration
-                }
-                tasks = append(tasks, taskListItem{task, duration})
-            case filter = <-filters:
-                for i > 0 && slices[i-1].duration <= filter {
-                    i--
-                }
-            }
-            if filter == 0.0 || i == len(slices) {
-                continue
-            }
-            if slices[i].duration < filter && i > 0 {
-                slices = append(slices[:i], slices[i-1:]...)
-                slices[i].duration = filter
-            }
-            slice := &slices[i]
-            var found bool = false
-            for (slice.offset - offset) < len(tasks) {
-                item := &tasks[slice.offset-offset]
-                if item.task == nil || i > 0 && item.duration > slice.duration {
-                    slice.offset++
-                } else if found {
-                    break
-                } else {
-                    output <- item.task
-                    item.task = nil
-                    found = true
-                }
-            }
+func (l *taskList) push(w Waiting) {
+    l.entries = append(l.entries, w)
+}
 
-            //cleanup_slices:
-            {
-                var ii int = i + 1
-                for ii < len(slices) && (slices[ii].offset-slice.offset) < 0 {
-                    ii++
-                }
-                if ii > i+1 {
-                    slices = append(slices[:i+1], slices[ii:]...)
-                }
-            }
+func (l *taskList) pushFront(w Waiting) {
+    l.entries = append([]Waiting{w}, l.entries...)
+}
 
-            //cleanup_tasks:
-            if i == 0 && (slice.offset-offset) > 0 {
-                tasks = tasks[slice.offset-offset:]
-                offset = slice.offset
-            }
+// first returns the first task of at most maxLevel, or nil.
+// Waiting "default" tasks are of the first level.
+func (l *taskList) first(maxLevel int) Waiting {
+    for _, w := range l.entries {
+        if w.Level() <= maxLevel {
+            return w
+        }
+    }
+    return nil
+}
 
-            if found {
-                i, filter = len(slices), 0.0
-            }
+func (l *taskList) remove(w Waiting) {
+    for i, x := range l.entries {
+        if x == w {
+            copy(l.entries[i:], l.entries[i+1:])
+            l.entries[len(l.entries)-1] = nil
+            l.entries = l.entries[:len(l.entries)-1]
+            return
         }
-    }(input, filters, output)
-    return &taskList{
-        input:   input,
-        filters: filters,
-        output:  output,
     }
 }
 
+func (l *taskList) len() int {
+    return len(l.entries)
+}
@@ -0,0 +1,297 @@
+package queue
+
+import (
+    "errors"
+    "io"
+    "log"
+    "net/http"
+    "os"
+    "strings"
+    "sync"
+    "time"
+
+    "golang.org/x/net/websocket"
+
+    "asyonline/server/server"
+)
+
+// Workers are backends that connect to the queue, rather than the queue
+// connecting to them. A worker keeps a control connection to UplinkPath;
+// for each task, the queue sends a token over it, and the worker opens
+// a connection to UplinkPath+"/task/"+token, which then carries the task
+// like a connection to "/asy" of a backend.
+//
+// UplinkPath is the path of control connections.
+const UplinkPath = "/worker"
+
+// a control connection is considered lost after this much silence;
+// both sides send an empty message every heartbeatInterval
+const uplinkTimeout time.Duration = 30e9 // 30s
+
+// uplinkMessage is a message of a control connection
+type uplinkMessage struct {
+    // sent by the worker first
+    Name     string `json:"name,omitempty"`
+    Capacity int    `json:"capacity,omitempty"`
+    // sent by the queue: the worker must connect for a task
+    Task string `json:"task,omitempty"`
+    // sent by the worker: no new tasks, running ones will finish
+    Shutdown bool `json:"shutdown,omitempty"`
+}
+
+// workerBackend runs tasks on a worker connected to the queue
+type workerBackend struct {
+    queue   *Queue
+    name    string
+    control *websocket.Conn
+    // sync of sends over control
+    mutex sync.Mutex
+}
+
+func (b *workerBackend) send(msg *uplinkMessage) error {
+    b.mutex.Lock()
+    defer b.mutex.Unlock()
+    return websocket.JSON.Send(b.control, msg)
+}
+
+func (b *workerBackend) run(
+    t *Task, duration float64, durations <-chan float64,
+) error {
+    token, connected, err := b.queue.workerConns.expect()
+    if err != nil {
+        return err
+    }
+    defer b.queue.workerConns.cancel(token, connected)
+    if err := b.send(&uplinkMessage{Task: token}); err != nil {
+        return err
+    }
+    select {
+    case pc := <-connected:
+        defer close(pc.done)
+        return t.runOn(pc.ws, duration, durations)
+    case <-time.After(dialTimeout):
+        return errors.New("worker " + b.name + " did not connect")
+    case <-t.Stopped:
+        return nil
+    }
+}
+
+// WorkerHandler returns the handler of connections of workers at
+// UplinkPath and below. Authentication is up to the caller.
+func (queue *Queue) WorkerHandler() http.Handler {
+    return websocket.Server{
+        Config:    websocket.Config{Protocol: []string{server.ProtocolJSONAsy}},
+        Handshake: server.Handshake(server.ProtocolJSONAsy),
+        Handler: websocket.Handler(func(ws *websocket.Conn) {
+            path := ws.Request().URL.Path
+            if path == UplinkPath {
+                queue.serveWorker(ws)
+                return
+            }
+            queue.workerConns.accept(
+                strings.TrimPrefix(path, UplinkPath+"/task/"), ws)
+        }),
+    }
+}
+
+// serveWorker adds the worker connected over ws to the backends,
+// for as long as it stays connected
+func (queue *Queue) serveWorker(ws *websocket.Conn) {
+    var hello uplinkMessage
+    ws.SetReadDeadline(time.Now().Add(uplinkTimeout))
+    if err := websocket.JSON.Receive(ws, &hello); err != nil {
+        log.Print("worker: ", err)
+        return
+    }
+    if hello.Capacity < 1 {
+        log.Print("worker: 'capacity' must be positive")
+        return
+    }
+    b := &workerBackend{
+        queue:   queue,
+        name:    hello.Name + " (" + ws.Request().RemoteAddr + ")",
+        control: ws,
+    }
+    d := queue.dispatch
+    m := &member{
+        name:     "worker " + b.name,
+        backend:  b,
+        capacity: hello.Capacity,
+    }
+    d.do(func() {
+        d.members = append(d.members, m)
+    })
+    log.Printf("worker %s connected, capacity %d", b.name, hello.Capacity)
+    defer d.do(func() {
+        d.remove(m)
+    })
+    stopped := make(chan void)
+    defer close(stopped)
+    go func() {
+        ticker := time.NewTicker(heartbeatInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                if err := b.send(&uplinkMessage{}); err != nil {
+                    return
+                }
+            case <-stopped:
+                return
+            }
+        }
+    }()
+    for {
+        var msg uplinkMessage
+        ws.SetReadDeadline(time.Now().Add(uplinkTimeout))
+        if err := websocket.JSON.Receive(ws, &msg); err != nil {
+            if !errors.Is(err, io.EOF) {
+                log.Printf("worker %s: %v", b.name, err)
+            }
+            log.Printf("worker %s disconnected", b.name)
+            return
+        }
+        if msg.Shutdown {
+            log.Printf("worker %s is shutting down", b.name)
+            d.do(func() {
+                m.draining = true
+            })
+        }
+    }
+}
+
+// UplinkConfig holds settings of an Uplink.
+type UplinkConfig struct {
+    // URL of the queue, like "ws://queue:8080/worker"
+    URL string
+    // bearer token of workers of the queue
+    Token string
+    // name of the worker in logs of the queue; defaults to the hostname
+    Name string
+    // number of concurrent tasks
+    Capacity int
+    // runs a task that comes over ws, like a backend at "/asy"
+    Serve func(ws *websocket.Conn)
+}
+
+// Uplink connects a backend to a queue as a worker, reconnecting
+// with exponential backoff.
+type Uplink struct {
+    config   *UplinkConfig
+    header   http.Header
+    stopping chan void
+    stopOnce sync.Once
+    tasks    sync.WaitGroup
+}
+
+func NewUplink(config *UplinkConfig) *Uplink {
+    header := make(http.Header)
+    if config.Token != "" {
+        header.Set("Authorization", "Bearer "+config.Token)
+    }
+    return &Uplink{
+        config:   config,
+        header:   header,
+        stopping: make(chan void),
+    }
+}
+
+// Run keeps the worker connected until Shutdown, then waits for
+// the running tasks to finish.
+func (u *Uplink) Run() error {
+    backoff := minBackoff
+    for {
+        connected, err := u.session()
+        if err != nil {
+            log.Print("uplink: ", err)
+        }
+        if connected {
+            backoff = minBackoff
+        }
+        select {
+        case <-u.stopping:
+            u.tasks.Wait()
+            return nil
+        case <-time.After(backoff):
+        }
+        if backoff *= 2; backoff > maxBackoff {
+            backoff = maxBackoff
+        }
+    }
+}
+
+// Shutdown reports to the queue that the worker takes no new tasks
+func (u *Uplink) Shutdown() {
+    u.stopOnce.Do(func() { close(u.stopping) })
+}
+
+// session runs one control connection, reporting whether it was
+// established
+func (u *Uplink) session() (connected bool, err error) {
+    ws, err := dial(u.config.URL, u.header)
+    if err != nil {
+        return false, err
+    }
+    defer ws.Close()
+    name := u.config.Name
+    if name == "" {
+        name, _ = os.Hostname()
+    }
+    err = websocket.JSON.Send(ws, &uplinkMessage{
+        Name: name, Capacity: u.config.Capacity})
+    if err != nil {
+        return true, err
+    }
+    log.Print("uplink: connected to ", u.config.URL)
+    stopped := make(chan void)
+    defer close(stopped)
+    // the only sender after the first message
+    go func() {
+        ticker := time.NewTicker(heartbeatInterval)
+        defer ticker.Stop()
+        for {
+            select {
+            case <-ticker.C:
+                if err := websocket.JSON.Send(ws, &uplinkMessage{}); err != nil {
+                    return
+                }
+            case <-u.stopping:
+                websocket.JSON.Send(ws, &uplinkMessage{Shutdown: true})
+                ws.Close()
+                return
+            case <-stopped:
+                return
+            }
+        }
+    }()
+    for {
+        var msg uplinkMessage
+        ws.SetReadDeadline(time.Now().Add(uplinkTimeout))
+        if err := websocket.JSON.Receive(ws, &msg); err != nil {
+            select {
+            case <-u.stopping:
+                return true, nil
+            default:
+            }
+            if errors.Is(err, io.EOF) {
+                err = errors.New("disconnected")
+            }
+            return true, err
+        }
+        if msg.Task != "" {
+            u.tasks.Add(1)
+            go u.runTask(msg.Task)
+        }
+    }
+}
+
+func (u *Uplink) runTask(token string) {
+    defer u.tasks.Done()
+    ws, err := dial(u.config.URL+"/task/"+token, u.header)
+    if err != nil {
+        log.Print("uplink: ", err)
+        return
+    }
+    defer ws.Close()
+    u.config.Serve(ws)
+}
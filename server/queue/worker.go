@@ -0,0 +1,365 @@
+package queue
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "errors"
+    "log"
+    "net/http"
+    "strconv"
+    "strings"
+    "sync"
+    "sync/atomic"
+    "time"
+
+    "github.com/redis/go-redis/v9"
+    "golang.org/x/net/websocket"
+
+    "asyonline/server/server"
+)
+
+// WorkerPath is the path of per-task URLs of a Worker
+const WorkerPath = "/asy/task/"
+
+// how long a Worker waits for the frontend to connect
+const connectTimeout time.Duration = 30e9 // 30s
+
+// WorkerConfig holds settings of a Worker.
+type WorkerConfig struct {
+    // address of the Redis server
+    Redis string
+    // address of the worker as seen by queue frontends, like
+    // "backend1:8081"
+    Addr string
+    // number of concurrent tasks
+    Capacity int
+    // creates tasks, like asy.NewTask
+    NewTask func(conn LocalConn) (LocalTask, error)
+}
+
+// Worker is a backend of the Redis queue, see plan-queue.md.
+// It takes tasks from queue.outcoming, and the frontends of the tasks
+// connect to it at per-task URLs to receive the output.
+type Worker struct {
+    config *WorkerConfig
+    redis  *redis.Client
+    // backend IDs, one for each concurrent task
+    slots    []string
+    stopping chan void
+    stopOnce sync.Once
+    done     sync.WaitGroup
+    // frontend connections at per-task URLs
+    conns pendingConns
+    // number of running tasks
+    busy atomic.Int32
+}
+
+func NewWorker(config *WorkerConfig) *Worker {
+    return &Worker{
+        config:   config,
+        redis:    newRedis(config.Redis),
+        stopping: make(chan void),
+        conns:    newPendingConns(),
+    }
+}
+
+// Run registers the worker and runs tasks until Shutdown. The worker
+// is unregistered before Run returns.
+func (w *Worker) Run() error {
+    if err := createGroup(w.redis); err != nil {
+        return err
+    }
+    for i := 0; i < w.config.Capacity; i++ {
+        id, err := w.register()
+        if err != nil {
+            w.unregister()
+            return err
+        }
+        w.slots = append(w.slots, id)
+    }
+    log.Printf("registered as backends %s", strings.Join(w.slots, ", "))
+    w.done.Add(1)
+    go w.heartbeatLoop()
+    for _, id := range w.slots {
+        w.done.Add(1)
+        go w.slotLoop(id)
+    }
+    w.done.Wait()
+    w.unregister()
+    return nil
+}
+
+// Busy returns the number of running tasks
+func (w *Worker) Busy() int {
+    return int(w.busy.Load())
+}
+
+// Shutdown stops taking tasks and stops the running ones
+func (w *Worker) Shutdown() {
+    w.stopOnce.Do(func() { close(w.stopping) })
+}
+
+func (w *Worker) register() (string, error) {
+    n, err := w.redis.Incr(ctx, keyBackendCounter).Result()
+    if err != nil {
+        return "", err
+    }
+    id := strconv.FormatInt(n, 10)
+    _, err = w.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+        p.SAdd(ctx, keyBackendSet, id)
+        p.Set(ctx, backendKey(id), "", backendTTL)
+        p.RPush(ctx, keyBackendUpdated, id)
+        return nil
+    })
+    return id, err
+}
+
+func (w *Worker) unregister() {
+    for _, id := range w.slots {
+        _, err := w.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+            p.Del(ctx, backendKey(id))
+            p.SRem(ctx, keyBackendSet, id)
+            p.RPush(ctx, keyBackendUpdated, id)
+            return nil
+        })
+        if err != nil {
+            log.Print(err)
+        }
+    }
+}
+
+// heartbeatLoop delays the backend keys from expiring, and registers
+// the backends again if the scheduler lost them
+func (w *Worker) heartbeatLoop() {
+    defer w.done.Done()
+    ticker := time.NewTicker(heartbeatInterval)
+    defer ticker.Stop()
+    for {
+        select {
+        case <-ticker.C:
+        case <-w.stopping:
+            return
+        }
+        for _, id := range w.slots {
+            var added *redis.IntCmd
+            _, err := w.redis.Pipelined(ctx, func(p redis.Pipeliner) error {
+                p.Set(ctx, backendKey(id), "", backendTTL)
+                added = p.SAdd(ctx, keyBackendSet, id)
+                return nil
+            })
+            if err == nil && added.Val() > 0 {
+                err = w.redis.RPush(ctx, keyBackendUpdated, id).Err()
+            }
+            if err != nil {
+                log.Print(err)
+            }
+        }
+    }
+}
+
+// slotLoop takes tasks one at a time for the backend id
+func (w *Worker) slotLoop(id string) {
+    defer w.done.Done()
+    for {
+        select {
+        case <-w.stopping:
+            return
+        default:
+        }
+        streams, err := w.redis.XReadGroup(ctx, &redis.XReadGroupArgs{
+            Group:    groupBackends,
+            Consumer: backendKey(id),
+            Streams:  []string{keyOutcoming, ">"},
+            Count:    1,
+            Block:    pollInterval,
+        }).Result()
+        if errors.Is(err, redis.Nil) {
+            continue
+        }
+        if err != nil {
+            log.Print(err)
+            select {
+            case <-time.After(pollInterval):
+            case <-w.stopping:
+                return
+            }
+            continue
+        }
+        for _, stream := range streams {
+            for _, msg := range stream.Messages {
+                w.run(msg)
+            }
+        }
+    }
+}
+
+// run takes the task of msg from the queue, waits for its frontend
+// to connect and runs the task
+func (w *Worker) run(msg redis.XMessage) {
+    id, _ := msg.Values["task"].(string)
+    durationS, _ := msg.Values["duration"].(string)
+    token, connected, err := w.conns.expect()
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    defer w.conns.cancel(token, connected)
+    var fields *redis.MapStringStringCmd
+    _, err = w.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+        p.XAck(ctx, keyOutcoming, groupBackends, msg.ID)
+        p.XDel(ctx, keyOutcoming, msg.ID)
+        p.SAdd(ctx, keyProcessing, id)
+        fields = p.HGetAll(ctx, taskKey(id))
+        p.RPush(ctx, backendURLKey(id),
+            "ws://"+w.config.Addr+WorkerPath+token)
+        p.Expire(ctx, backendURLKey(id), taskTTL)
+        return nil
+    })
+    defer w.finish(id)
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    if len(fields.Val()) == 0 {
+        // aborted
+        return
+    }
+    files, err := w.redis.HGetAll(ctx, filesKey(id)).Result()
+    if err == nil {
+        err = w.redis.Del(ctx, filesKey(id)).Err()
+    }
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    t, err := taskOf(fields.Val(), files)
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    duration, err := strconv.ParseFloat(durationS, 64)
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    select {
+    case pc := <-connected:
+        defer close(pc.done)
+        w.serve(t, duration, pc.ws)
+    case <-time.After(connectTimeout):
+        log.Printf("task %s: frontend did not connect", id)
+    case <-w.stopping:
+    }
+}
+
+// serve runs the task, sending its output to the frontend over ws
+func (w *Worker) serve(t *Task, duration float64, ws *websocket.Conn) {
+    w.busy.Add(1)
+    defer w.busy.Add(-1)
+    conn := server.NewConn(ws, nil)
+    defer conn.Close()
+    lt, err := w.config.NewTask(conn)
+    if err != nil {
+        conn.Deny(err)
+        return
+    }
+    defer lt.Stop()
+    if err := t.configure(lt, duration); err != nil {
+        conn.Deny(err)
+        return
+    }
+    // the frontend sends duration updates
+    conn.HandleWith(lt)
+    select {
+    case <-lt.Done():
+    case <-conn.Stopped:
+    case <-w.stopping:
+    }
+}
+
+// finish moves the task to queue.finished
+func (w *Worker) finish(id string) {
+    _, err := w.redis.TxPipelined(ctx, func(p redis.Pipeliner) error {
+        p.SRem(ctx, keyProcessing, id)
+        p.RPush(ctx, keyFinished, id)
+        p.Del(ctx, backendURLKey(id))
+        return nil
+    })
+    if err != nil {
+        log.Print(err)
+    }
+}
+
+// Handler accepts connections of frontends at per-task URLs
+func (w *Worker) Handler() http.Handler {
+    return websocket.Server{
+        Config:    websocket.Config{Protocol: []string{server.ProtocolJSONAsy}},
+        Handshake: server.Handshake(server.ProtocolJSONAsy),
+        Handler: websocket.Handler(func(ws *websocket.Conn) {
+            w.conns.accept(
+                strings.TrimPrefix(ws.Request().URL.Path, WorkerPath), ws)
+        }),
+    }
+}
+
+// pendingConns passes websocket connections at per-task URLs
+// from their handlers to the tasks that expect them
+type pendingConns struct {
+    mutex sync.Mutex
+    // by tokens of the URLs
+    conns map[string]chan pendingConn
+}
+
+// pendingConn is a connection at a per-task URL. The handler
+// of the connection returns when done is closed.
+type pendingConn = struct {
+    ws   *websocket.Conn
+    done chan void
+}
+
+func newPendingConns() pendingConns {
+    return pendingConns{conns: make(map[string]chan pendingConn)}
+}
+
+// expect returns a random token for a per-task URL, and a channel
+// that receives the connection at the URL.
+// The token must be cancelled when the task ends.
+func (p *pendingConns) expect() (string, chan pendingConn, error) {
+    var tokenB [16]byte
+    if _, err := rand.Read(tokenB[:]); err != nil {
+        return "", nil, err
+    }
+    token := hex.EncodeToString(tokenB[:])
+    connected := make(chan pendingConn, 1)
+    p.mutex.Lock()
+    p.conns[token] = connected
+    p.mutex.Unlock()
+    return token, connected, nil
+}
+
+func (p *pendingConns) cancel(token string, connected chan pendingConn) {
+    p.mutex.Lock()
+    delete(p.conns, token)
+    p.mutex.Unlock()
+    // the connection may have come too late
+    select {
+    case pc := <-connected:
+        close(pc.done)
+    default:
+    }
+}
+
+// accept passes ws to the task that expects it, and waits
+// until the task is done with it
+func (p *pendingConns) accept(token string, ws *websocket.Conn) {
+    p.mutex.Lock()
+    connected, ok := p.conns[token]
+    delete(p.conns, token)
+    p.mutex.Unlock()
+    if !ok {
+        return
+    }
+    done := make(chan void)
+    connected <- pendingConn{ws, done}
+    <-done
+}
@@ -0,0 +1,85 @@
+package cache
+
+import (
+    "container/list"
+    "sync"
+    "time"
+)
+
+// Cache keeps recently uploaded source files, addressed by their SHA-256
+// hash, so that clients may restore them instead of uploading them again.
+// Entries are evicted when they were not used for ttl, or when the total
+// size of all entries exceeds maxSize (least recently used first).
+type Cache struct {
+    mutex   sync.Mutex
+    entries map[string]*list.Element
+    order   *list.List // most recently used at front
+    size    int
+    maxSize int
+    ttl     time.Duration
+}
+
+type entry struct {
+    hash     string
+    contents []byte
+    expires  time.Time
+}
+
+func New(maxSize int, ttl time.Duration) *Cache {
+    return &Cache{
+        entries: make(map[string]*list.Element),
+        order:   list.New(),
+        maxSize: maxSize,
+        ttl:     ttl,
+    }
+}
+
+func (c *Cache) Store(hash string, contents []byte) {
+    if len(contents) > c.maxSize {
+        return
+    }
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    now := time.Now()
+    if elem, ok := c.entries[hash]; ok {
+        elem.Value.(*entry).expires = now.Add(c.ttl)
+        c.order.MoveToFront(elem)
+        return
+    }
+    c.entries[hash] = c.order.PushFront(&entry{
+        hash:     hash,
+        contents: contents,
+        expires:  now.Add(c.ttl),
+    })
+    c.size += len(contents)
+    c.evict(now)
+}
+
+func (c *Cache) Load(hash string) ([]byte, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    now := time.Now()
+    c.evict(now)
+    elem, ok := c.entries[hash]
+    if !ok {
+        return nil, false
+    }
+    e := elem.Value.(*entry)
+    e.expires = now.Add(c.ttl)
+    c.order.MoveToFront(elem)
+    return e.contents, true
+}
+
+// sync: c.mutex must be held
+func (c *Cache) evict(now time.Time) {
+    for elem := c.order.Back(); elem != nil; elem = c.order.Back() {
+        e := elem.Value.(*entry)
+        if c.size <= c.maxSize && now.Before(e.expires) {
+            // the rest of entries were used later than this one
+            return
+        }
+        c.order.Remove(elem)
+        delete(c.entries, e.hash)
+        c.size -= len(e.contents)
+    }
+}
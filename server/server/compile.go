@@ -0,0 +1,357 @@
+package server
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "math"
+    "net"
+    "net/http"
+    "strconv"
+    "sync"
+
+    "asyonline/server/common/stopper"
+    "asyonline/server/server/message"
+    "asyonline/server/server/reply"
+)
+
+// maximum size of a compile request, bytes
+const maxCompileSize = 1 << 20 // 1MiB
+
+// content types of results by format
+var contentTypes = map[string]string{
+    "svg": "image/svg+xml",
+    "pdf": "application/pdf",
+    "png": "image/png",
+}
+
+func contentType(format string) string {
+    if t, ok := contentTypes[format]; ok {
+        return t
+    }
+    return "application/octet-stream"
+}
+
+// outputPolicy keeps scripts and external resources of an SVG result
+// from loading when the result is opened in a browser
+const outputPolicy = "default-src 'none'; style-src 'unsafe-inline'; sandbox"
+
+// setOutputHeaders sets the type of a response that carries output of
+// a task, and keeps browsers from running or sniffing it
+func setOutputHeaders(w http.ResponseWriter, contentType string) {
+    header := w.Header()
+    header.Set("Content-Type", contentType)
+    header.Set("Content-Security-Policy", outputPolicy)
+    header.Set("X-Content-Type-Options", "nosniff")
+}
+
+// submission holds the source files and options of a task submitted
+// over HTTP, see plan-proto.md
+type submission struct {
+    files   map[string][]byte
+    options message.Options
+    main    string
+    // identifies the client by its IP address
+    client string
+}
+
+// readSubmission reads the multipart form of a POST request
+func readSubmission(w http.ResponseWriter, req *http.Request,
+) (*submission, error) {
+    s := &submission{
+        files:  make(map[string][]byte),
+        client: clientOf(req),
+    }
+    if req.Method != http.MethodPost {
+        return s, reply.Error("Compile requests must be POST")
+    }
+    req.Body = http.MaxBytesReader(w, req.Body, maxCompileSize)
+    if err := req.ParseMultipartForm(maxCompileSize); err != nil {
+        return s, reply.Error("The request is not a correct multipart form")
+    }
+    form := req.MultipartForm
+    defer form.RemoveAll()
+    for _, headers := range form.File {
+        for _, header := range headers {
+            file, err := header.Open()
+            if err != nil {
+                return s, err
+            }
+            contents, err := io.ReadAll(file)
+            file.Close()
+            if err != nil {
+                return s, err
+            }
+            s.files[header.Filename] = contents
+        }
+    }
+    if len(s.files) == 0 {
+        return s, reply.Error("The request has no source files")
+    }
+    value := func(name string) (string, bool) {
+        values := form.Value[name]
+        if len(values) == 0 {
+            return "", false
+        }
+        return values[0], true
+    }
+    if v, ok := value("duration"); ok {
+        duration, err := strconv.ParseFloat(v, 64)
+        if err != nil {
+            return s, reply.Error("'duration' must be a number")
+        }
+        s.options.Duration = &duration
+    }
+    if v, ok := value("format"); ok {
+        s.options.Format = &v
+    }
+    if v, ok := value("stderrRedir"); ok {
+        stderrRedir, err := strconv.ParseBool(v)
+        if err != nil {
+            return s, reply.Error("'stderrRedir' must be true or false")
+        }
+        s.options.StderrRedir = &stderrRedir
+    }
+    if v, ok := value("verbosity"); ok {
+        verbosity, err := strconv.Atoi(v)
+        if err != nil {
+            return s, reply.Error("'verbosity' must be an integer")
+        }
+        s.options.Verbosity = &verbosity
+    }
+    s.main, _ = value("main")
+    if s.main == "" {
+        if len(s.files) > 1 {
+            return s, reply.Error("'main' must be set with several files")
+        }
+        for filename := range s.files {
+            s.main = filename
+        }
+    }
+    return s, nil
+}
+
+// start passes the files and options to t and starts it
+func (s *submission) start(t task) error {
+    for filename, contents := range s.files {
+        if err := t.AddFile(filename, contents); err != nil {
+            return err
+        }
+    }
+    if err := setOptions(t, &s.options); err != nil {
+        return err
+    }
+    return t.Start(s.main)
+}
+
+func clientOf(req *http.Request) string {
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+    return host
+}
+
+// CompileOutput is output of a task, in an error response
+type CompileOutput struct {
+    Stream string `json:"stream"`
+    Text   string `json:"text"`
+}
+
+// failure is the response to a task that did not produce an image
+type failure struct {
+    Error  string          `json:"error"`
+    Busy   *message.Busy   `json:"busy,omitempty"`
+    Output []CompileOutput `json:"output,omitempty"`
+}
+
+// collector takes the sender methods of Conn, and keeps the outcome
+// of a task that runs without a websocket connection
+type collector struct {
+    stopper.Stopper
+    mutex sync.Mutex
+    // the process started
+    started bool
+    output  []CompileOutput
+    format  string
+    result  []byte
+    // set when the task completes or is denied
+    done   bool
+    denied bool
+    err    error
+}
+
+func newCollector() collector {
+    return collector{Stopper: stopper.New()}
+}
+
+// finish records the outcome of the task, unless it is known already
+func (c *collector) finish(err error, denied bool) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.done {
+        return errClosed
+    }
+    if err == nil && c.result == nil {
+        err = reply.Error("No image output")
+    }
+    c.done, c.denied, c.err = true, denied, err
+    c.Stop()
+    return nil
+}
+
+func (c *collector) Deny(err error) {
+    if err == nil {
+        err = errors.New("denied without an error")
+    }
+    c.finish(err, true)
+}
+
+func (c *collector) SendOutput(stream string, output []byte) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.done {
+        return errClosed
+    }
+    // empty output indicates the start of the process
+    c.started = true
+    if len(output) > 0 {
+        c.output = append(c.output, CompileOutput{stream, string(output)})
+    }
+    return nil
+}
+
+func (c *collector) SendResult(format string, contents []byte) error {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    if c.done {
+        return errClosed
+    }
+    c.format, c.result = format, contents
+    return nil
+}
+
+func (c *collector) Complete(err error) error {
+    return c.finish(err, false)
+}
+
+// interrupt fails the task unless it completed or was denied,
+// like when it stopped after its backend was lost
+func (c *collector) interrupt() {
+    c.finish(errors.New("the task was interrupted"), false)
+}
+
+// failure describes the outcome of a task that failed, with the HTTP
+// status of the response. The task must be done.
+func (c *collector) failure() (*failure, int) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    f := &failure{Output: c.output}
+    status := http.StatusUnprocessableEntity
+    switch e := c.err.(type) {
+    case reply.Error:
+        f.Error = e.Error()
+        if c.denied {
+            status = http.StatusBadRequest
+        }
+    case reply.Busy:
+        f.Error = e.Error()
+        f.Busy = &message.Busy{RetryAfter: e.RetryAfter}
+        status = http.StatusServiceUnavailable
+    default:
+        log.Print(e)
+        f.Error = "Server error"
+        status = http.StatusInternalServerError
+    }
+    return f, status
+}
+
+// writeFailure responds with the failure of the task as JSON
+func (c *collector) writeFailure(w http.ResponseWriter) {
+    f, status := c.failure()
+    if f.Busy != nil {
+        w.Header().Set("Retry-After",
+            strconv.Itoa(int(math.Ceil(f.Busy.RetryAfter))))
+    }
+    writeJSON(w, f, status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}, status int) {
+    // failures and job statuses carry output
+    setOutputHeaders(w, "application/json")
+    w.WriteHeader(status)
+    if err := json.NewEncoder(w).Encode(v); err != nil {
+        log.Print(err)
+    }
+}
+
+// Compilation runs a task for a POST request of the HTTP compile API
+// (see plan-proto.md), instead of a websocket connection. It takes
+// the same sender methods as Conn, and responds with the result, or
+// with the error and the output of the task.
+type Compilation struct {
+    collector
+    w   http.ResponseWriter
+    req *http.Request
+    s   *submission
+}
+
+// NewCompilation reads the source files and options of the request.
+// The compilation is denied right away if they are malformed.
+func NewCompilation(w http.ResponseWriter, req *http.Request) *Compilation {
+    c := &Compilation{
+        collector: newCollector(),
+        w:         w,
+        req:       req,
+    }
+    var err error
+    c.s, err = readSubmission(w, req)
+    if err != nil {
+        c.Deny(err)
+    }
+    return c
+}
+
+// Client identifies the client by its IP address
+func (c *Compilation) Client() string {
+    return c.s.client
+}
+
+// HandleWith passes the files and options of the request to t and
+// starts it. The compilation stops if the client goes away.
+func (c *Compilation) HandleWith(t task) {
+    select {
+    case <-c.Stopped:
+        return
+    default:
+    }
+    go func() {
+        select {
+        case <-c.req.Context().Done():
+            c.Stop()
+        case <-c.Stopped:
+        }
+    }()
+    if err := c.s.start(t); err != nil {
+        c.Deny(err)
+    }
+}
+
+// SendStatus drops queue status, the client only waits for the response
+func (c *Compilation) SendStatus(status *message.Status) error {
+    return nil
+}
+
+// Close writes the response. The compilation must be stopped.
+func (c *Compilation) Close() {
+    c.interrupt()
+    if c.err != nil {
+        c.writeFailure(c.w)
+        return
+    }
+    setOutputHeaders(c.w, contentType(c.format))
+    if _, err := c.w.Write(c.result); err != nil {
+        log.Print(err)
+    }
+}
@@ -0,0 +1,192 @@
+package server
+
+import (
+    "bytes"
+    "encoding/json"
+    "mime/multipart"
+    "net/http"
+    "net/http/httptest"
+    "strings"
+    "testing"
+
+    "asyonline/server/server/reply"
+)
+
+// compileRequest returns a POST request of the compile form, with source
+// files of the given names and the given form fields
+func compileRequest(tb testing.TB, path string, fields map[string]string,
+    files ...string,
+) *http.Request {
+    tb.Helper()
+    var body bytes.Buffer
+    form := multipart.NewWriter(&body)
+    for _, filename := range files {
+        part, err := form.CreateFormFile("file", filename)
+        if err != nil {
+            tb.Fatal(err)
+        }
+        part.Write([]byte("draw((0,0)--(1,1));"))
+    }
+    for name, value := range fields {
+        form.WriteField(name, value)
+    }
+    form.Close()
+    req := httptest.NewRequest(http.MethodPost, path, &body)
+    req.Header.Set("Content-Type", form.FormDataContentType())
+    return req
+}
+
+// fakeTask records the files and options that it is given
+type fakeTask struct {
+    files    []string
+    duration float64
+    format   string
+    mainname string
+}
+
+func (t *fakeTask) AddFile(filename string, contents []byte) error {
+    t.files = append(t.files, filename)
+    return nil
+}
+
+func (t *fakeTask) SetDuration(duration float64) error {
+    t.duration = duration
+    return nil
+}
+
+func (t *fakeTask) SetFormat(format string) error {
+    t.format = format
+    return nil
+}
+
+func (t *fakeTask) SetStderrRedir(stderrRedir bool) error { return nil }
+func (t *fakeTask) SetVerbosity(verbosity int) error      { return nil }
+
+func (t *fakeTask) Start(mainname string) error {
+    t.mainname = mainname
+    return nil
+}
+
+func (t *fakeTask) Stop() {}
+
+// compile serves req with a compilation, whose task is run by run
+// unless the request is denied right away
+func compile(req *http.Request, run func(c *Compilation),
+) *httptest.ResponseRecorder {
+    w := httptest.NewRecorder()
+    c := NewCompilation(w, req)
+    select {
+    case <-c.Stopped:
+    default:
+        run(c)
+    }
+    c.Close()
+    return w
+}
+
+func checkOutputHeaders(tb testing.TB, w *httptest.ResponseRecorder,
+    contentType string,
+) {
+    tb.Helper()
+    header := w.Header()
+    if got := header.Get("Content-Type"); got != contentType {
+        tb.Errorf("Content-Type %q, expected %q", got, contentType)
+    }
+    if got := header.Get("Content-Security-Policy"); got != outputPolicy {
+        tb.Errorf("Content-Security-Policy %q", got)
+    }
+    if got := header.Get("X-Content-Type-Options"); got != "nosniff" {
+        tb.Errorf("X-Content-Type-Options %q", got)
+    }
+}
+
+func TestCompile(t *testing.T) {
+    task := &fakeTask{}
+    req := compileRequest(t, "/asy/compile",
+        map[string]string{"duration": "2.5", "format": "png"}, "main.asy")
+    w := compile(req, func(c *Compilation) {
+        c.HandleWith(task)
+        c.SendOutput("stdout", nil)
+        c.SendResult("png", []byte("PNG"))
+        c.Complete(nil)
+    })
+    if w.Code != http.StatusOK || w.Body.String() != "PNG" {
+        t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+    }
+    checkOutputHeaders(t, w, "image/png")
+    if task.mainname != "main.asy" || task.duration != 2.5 ||
+        task.format != "png" {
+        t.Errorf("task %+v", task)
+    }
+}
+
+func TestCompileDenied(t *testing.T) {
+    malformed := httptest.NewRequest(http.MethodPost, "/asy/compile",
+        strings.NewReader("draw((0,0));"))
+    malformed.Header.Set("Content-Type", "text/plain")
+    for name, req := range map[string]*http.Request{
+        "GET":       httptest.NewRequest(http.MethodGet, "/asy/compile", nil),
+        "malformed": malformed,
+        "no files":  compileRequest(t, "/asy/compile", nil),
+        "no main": compileRequest(t, "/asy/compile", nil,
+            "a.asy", "b.asy"),
+        "duration": compileRequest(t, "/asy/compile",
+            map[string]string{"duration": "long"}, "main.asy"),
+        "stderrRedir": compileRequest(t, "/asy/compile",
+            map[string]string{"stderrRedir": "maybe"}, "main.asy"),
+        "verbosity": compileRequest(t, "/asy/compile",
+            map[string]string{"verbosity": "1.5"}, "main.asy"),
+    } {
+        w := compile(req, func(c *Compilation) {
+            t.Errorf("%s: the request is not denied", name)
+            c.Complete(nil)
+        })
+        var f failure
+        if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+            t.Errorf("%s: %v", name, err)
+        }
+        if w.Code != http.StatusBadRequest || f.Error == "" {
+            t.Errorf("%s: status %d, error %q, expected 400", name,
+                w.Code, f.Error)
+        }
+        checkOutputHeaders(t, w, "application/json")
+    }
+}
+
+func TestCompileBusy(t *testing.T) {
+    req := compileRequest(t, "/asy/compile", nil, "main.asy")
+    w := compile(req, func(c *Compilation) {
+        c.Deny(reply.Busy{RetryAfter: 2.5})
+    })
+    var f failure
+    if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+        t.Fatal(err)
+    }
+    if w.Code != http.StatusServiceUnavailable || f.Busy == nil ||
+        f.Busy.RetryAfter != 2.5 {
+        t.Errorf("status %d, %+v, expected 503 with busy", w.Code, f)
+    }
+    if got := w.Header().Get("Retry-After"); got != "3" {
+        t.Errorf("Retry-After %q, expected 3", got)
+    }
+    checkOutputHeaders(t, w, "application/json")
+}
+
+func TestCompileFailed(t *testing.T) {
+    req := compileRequest(t, "/asy/compile", nil, "main.asy")
+    w := compile(req, func(c *Compilation) {
+        c.SendOutput("stdout", nil)
+        c.SendOutput("stderr", []byte("syntax error"))
+        c.Complete(reply.Error("Execution failed"))
+    })
+    var f failure
+    if err := json.Unmarshal(w.Body.Bytes(), &f); err != nil {
+        t.Fatal(err)
+    }
+    if w.Code != http.StatusUnprocessableEntity ||
+        f.Error != "Execution failed" || len(f.Output) != 1 ||
+        f.Output[0].Text != "syntax error" {
+        t.Errorf("status %d, %+v, expected 422 with output", w.Code, f)
+    }
+    checkOutputHeaders(t, w, "application/json")
+}
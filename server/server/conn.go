@@ -1,15 +1,20 @@
 package server
 
 import (
+    "crypto/sha256"
+    "encoding/hex"
     "encoding/json"
     "errors"
     "io"
     "log"
+    "net"
     "strings"
+    "sync"
 
     "golang.org/x/net/websocket"
 
     "asyonline/server/common/stopper"
+    "asyonline/server/server/message"
     "asyonline/server/server/reply"
 )
 
@@ -25,46 +30,108 @@ type task interface {
     Stop()
 }
 
+// task that runs an Asymptote shell
+type interactiveTask interface {
+    task
+    WriteStdin(input []byte) error
+}
+
 type cache interface {
+    Store(hash string, contents []byte)
+    Load(hash string) ([]byte, bool)
 }
 
 type Conn struct {
     stopper.Stopper
-    ws    *websocket.Conn
-    task  task
-    cache cache
+    ws          *websocket.Conn
+    json        bool // JSON protocol was negotiated
+    interactive bool // "interactive" sub-protocol was negotiated
+    task        task
+    itask       interactiveTask // same as task, if interactive
+    cache       cache           // nil unless "restore" was negotiated
+
+    // outbound messages, see sendLoop
+    outbox    chan outMessage
+    closing   chan void // closed by Close
+    closeOnce sync.Once
+    broken    chan void // closed by sendLoop on write errors
+    sent      chan void // closed when sendLoop ends
+
+    // only receive loop can access these
+    // files that were requested to be restored but were not found in cache
+    missing []message.File
+    // "missing" message can be sent only once
+    missingSent bool
+    // the task started, only some messages are accepted, see afterStart
+    started bool
 }
 
 func NewConn(ws *websocket.Conn, cache cache) *Conn {
+    protocol := negotiated(ws)
+    if !hasRestore(protocol) {
+        cache = nil
+    }
     conn := &Conn{
-        ws:      ws,
-        cache:   cache,
-        Stopper: stopper.New(),
+        ws:          ws,
+        json:        hasJSON(protocol),
+        interactive: hasInteractive(protocol),
+        cache:       cache,
+        Stopper:     stopper.New(),
+        outbox:      make(chan outMessage, outboxSize),
+        closing:     make(chan void),
+        broken:      make(chan void),
+        sent:        make(chan void),
     }
+    go conn.sendLoop()
     return conn
 }
 
-// XXX we should synchronize all sending methods because Deny may be executed concurrently with e.g. SendResult
+// Client identifies the client by its IP address
+func (conn *Conn) Client() string {
+    req := conn.ws.Request()
+    if req == nil {
+        return ""
+    }
+    host, _, err := net.SplitHostPort(req.RemoteAddr)
+    if err != nil {
+        return req.RemoteAddr
+    }
+    return host
+}
 
 func (conn *Conn) Deny(e error) {
     var err error
     var denyArgs = struct {
-        Error string `json:"error"`
+        Error string        `json:"error"`
+        Busy  *message.Busy `json:"busy,omitempty"`
     }{}
     switch e := e.(type) {
     case reply.Error:
         denyArgs.Error = e.Error()
+    case reply.Busy:
+        denyArgs.Error = e.Error()
+        denyArgs.Busy = &message.Busy{RetryAfter: e.RetryAfter}
     default:
         log.Print(e)
         denyArgs.Error = "Server error"
     }
+    if conn.json {
+        err = conn.sendJSON(&message.Message{
+            Error: &denyArgs.Error,
+            Busy:  denyArgs.Busy,
+        })
+        if err != nil {
+            log.Print(err)
+        }
+        return
+    }
     denyArgsB, err := json.Marshal(denyArgs)
     if err != nil {
         log.Print(err)
         return
     }
     denyMsg := "deny " + string(denyArgsB)
-    err = websocket.Message.Send(conn.ws, denyMsg)
+    err = conn.send(denyMsg)
     if err != nil {
         log.Print(err)
         return
@@ -73,6 +140,11 @@ func (conn *Conn) Deny(e error) {
 
 func (conn *Conn) SendOutput(name string, output []byte) error {
     var err error
+    if conn.json {
+        return conn.sendJSON(&message.Message{
+            Output: []message.Output{{Stream: name, Blob: message.Blob(0)}},
+        }, output)
+    }
     var outputArgs = struct {
         Stream string `json:"stream"`
     }{
@@ -83,19 +155,16 @@ func (conn *Conn) SendOutput(name string, output []byte) error {
         return err
     }
     outputMsg := "output " + string(outputArgsB)
-    err = websocket.Message.Send(conn.ws, outputMsg)
-    if err != nil {
-        return err
-    }
-    err = websocket.Message.Send(conn.ws, output)
-    if err != nil {
-        return err
-    }
-    return nil
+    return conn.send(outputMsg, output)
 }
 
 func (conn *Conn) SendResult(format string, contents []byte) error {
     var err error
+    if conn.json {
+        return conn.sendJSON(&message.Message{
+            Output: []message.Output{{Format: format, Blob: message.Blob(0)}},
+        }, contents)
+    }
     var resultArgs = struct {
         Format string `json:"format"`
     }{
@@ -106,15 +175,19 @@ func (conn *Conn) SendResult(format string, contents []byte) error {
         return err
     }
     resultMsg := "result " + string(resultArgsB)
-    err = websocket.Message.Send(conn.ws, resultMsg)
-    if err != nil {
-        return err
+    return conn.send(resultMsg, contents)
+}
+
+func (conn *Conn) SendStatus(status *message.Status) error {
+    if conn.json {
+        return conn.sendJSON(&message.Message{Status: status})
     }
-    err = websocket.Message.Send(conn.ws, contents)
+    statusArgsB, err := json.Marshal(status)
     if err != nil {
         return err
     }
-    return nil
+    statusMsg := "status " + string(statusArgsB)
+    return conn.send(statusMsg)
 }
 
 func (conn *Conn) Complete(e error) error {
@@ -131,21 +204,61 @@ func (conn *Conn) Complete(e error) error {
         log.Print(e)
         completeArgs.Error = "Server error"
     }
+    if conn.json {
+        if completeArgs.Error == "" {
+            return conn.sendJSON(&message.Message{Ok: 1})
+        }
+        return conn.sendJSON(&message.Message{Error: &completeArgs.Error})
+    }
     completeArgsB, err := json.Marshal(completeArgs)
     if err != nil {
         return err
     }
     completeMsg := "complete " + string(completeArgsB)
-    err = websocket.Message.Send(conn.ws, completeMsg)
+    return conn.send(completeMsg)
+}
+
+func (conn *Conn) sendMissing(missing []message.File) error {
+    var err error
+    if conn.json {
+        return conn.sendJSON(&message.Message{Missing: missing})
+    }
+    missingArgsB, err := json.Marshal(missing)
     if err != nil {
         return err
     }
-    return nil
+    missingMsg := "missing " + string(missingArgsB)
+    return conn.send(missingMsg)
 }
 
 func (conn *Conn) HandleWith(t task) {
     conn.task = t
-    go conn.receiveLoop()
+    if conn.interactive {
+        itask, ok := t.(interactiveTask)
+        if !ok {
+            conn.Deny(reply.Error("Interactive mode is not supported"))
+            conn.Stop()
+            return
+        }
+        conn.itask = itask
+    }
+    if conn.json {
+        go conn.receiveJSONLoop()
+    } else {
+        go conn.receiveLoop()
+    }
+}
+
+// receiveError logs err unless the connection was closed or stopped.
+func (conn *Conn) receiveError(err error) {
+    if errors.Is(err, io.EOF) {
+        return
+    }
+    select {
+    case <-conn.Stopped:
+    default:
+        log.Println("websocket receive:", err)
+    }
 }
 
 func (conn *Conn) receiveLoop() {
@@ -159,28 +272,21 @@ func (conn *Conn) receiveLoop() {
     )
 
     for {
-        var message string
-        err := websocket.Message.Receive(conn.ws, &message)
+        var msg string
+        err := websocket.Message.Receive(conn.ws, &msg)
         if err != nil {
-            if errors.Is(err, io.EOF) {
-                return
-            }
-            select {
-            case <-conn.Stopped:
-            default:
-                log.Println("websocket receive:", err)
-            }
+            conn.receiveError(err)
             return
         }
         switch {
-        case strings.HasPrefix(message, addPrefix):
+        case strings.HasPrefix(msg, addPrefix):
             var err error
             var addArgs struct {
                 Filename *string
                 Hash     *string
                 Restore  *bool
             }
-            err = json.Unmarshal([]byte(message[len(addPrefix):]), &addArgs)
+            err = json.Unmarshal([]byte(msg[len(addPrefix):]), &addArgs)
             if err != nil {
                 conn.Deny(reply.Error(
                     "'add' arguments are not a correct JSON"))
@@ -191,95 +297,301 @@ func (conn *Conn) receiveLoop() {
                 conn.Deny(reply.Error("'add' must specify a 'filename'"))
                 return
             }
-            if addArgs.Restore != nil {
-                if conn.cache == nil {
-                    conn.Deny(reply.Error("'restore' not enabled"))
+            if addArgs.Restore != nil && *addArgs.Restore {
+                err = conn.restoreFile(*addArgs.Filename, addArgs.Hash)
+                if err != nil {
+                    conn.Deny(err)
                     return
                 }
-                conn.Deny(reply.Error("XXX 'restore' not implemented"))
-                return
+                continue
             }
             err = websocket.Message.Receive(conn.ws, &contents)
             if err != nil {
                 log.Print(err)
                 return
             }
-            // XXX check for total file size
-            err = conn.task.AddFile(*addArgs.Filename, contents)
+            err = conn.addFile(*addArgs.Filename, addArgs.Hash, contents)
             if err != nil {
                 conn.Deny(err)
                 return
             }
-        case strings.HasPrefix(message, optionsPrefix):
+        case strings.HasPrefix(msg, optionsPrefix):
             var err error
-            var optionsArgs struct {
-                Duration    *float64
-                Format      *string
-                StderrRedir *bool `json:"stderrRedir"`
-                Verbosity   *int
-            }
+            var optionsArgs message.Options
             err = json.Unmarshal(
-                []byte(message[len(optionsPrefix):]), &optionsArgs)
+                []byte(msg[len(optionsPrefix):]), &optionsArgs)
             if err != nil {
                 conn.Deny(reply.Error(
                     "'options' arguments are not a correct JSON"))
                 return
             }
-            if optionsArgs.Duration != nil {
-                err = conn.task.SetDuration(*optionsArgs.Duration)
-                if err != nil {
-                    conn.Deny(err)
-                    return
-                }
-            }
-            if optionsArgs.Format != nil {
-                err = conn.task.SetFormat(*optionsArgs.Format)
-                if err != nil {
-                    conn.Deny(err)
-                    return
-                }
+            err = conn.setOptions(&optionsArgs)
+            if err != nil {
+                conn.Deny(err)
+                return
             }
-            if optionsArgs.StderrRedir != nil {
-                err = conn.task.SetStderrRedir(*optionsArgs.StderrRedir)
-                if err != nil {
-                    conn.Deny(err)
-                    return
-                }
+        case strings.HasPrefix(msg, startPrefix):
+            var err error
+            var startArgs message.Start
+            err = json.Unmarshal(
+                []byte(msg[len(startPrefix):]), &startArgs)
+            if err != nil {
+                conn.Deny(reply.Error(
+                    "'start' arguments are not a correct JSON"))
+                return
             }
-            if optionsArgs.Verbosity != nil {
-                err = conn.task.SetVerbosity(*optionsArgs.Verbosity)
-                if err != nil {
-                    conn.Deny(err)
-                    return
-                }
+            err = conn.start(&startArgs)
+            if err != nil {
+                conn.Deny(err)
+                return
             }
-        case strings.HasPrefix(message, startPrefix):
+        case strings.HasPrefix(msg, inputPrefix):
             var err error
-            var startArgs struct {
-                Main *string
+            var inputArgs struct {
+                Stream *string
             }
             err = json.Unmarshal(
-                []byte(message[len(startPrefix):]), &startArgs)
+                []byte(msg[len(inputPrefix):]), &inputArgs)
             if err != nil {
                 conn.Deny(reply.Error(
-                    "'start' arguments are not a correct JSON"))
+                    "'input' arguments are not a correct JSON"))
                 return
             }
-            if startArgs.Main == nil {
-                conn.Deny(reply.Error("'start' must specify a 'main' filename"))
+            var contents []byte
+            err = websocket.Message.Receive(conn.ws, &contents)
+            if err != nil {
+                log.Print(err)
                 return
             }
-            err = conn.task.Start(*startArgs.Main)
+            err = conn.writeInput(inputArgs.Stream, contents)
             if err != nil {
                 conn.Deny(err)
                 return
             }
-        case strings.HasPrefix(message, inputPrefix):
-            conn.Deny(reply.Error("XXX not implemented"))
-            return
         default:
             conn.Deny(reply.Error("unknown command"))
             return
         }
     }
 }
+
+func (conn *Conn) receiveJSONLoop() {
+    defer conn.Stop()
+
+    for {
+        msg, blobs, err := message.Receive(conn.ws)
+        if err != nil {
+            if _, ok := err.(reply.Error); ok {
+                conn.Deny(err)
+                return
+            }
+            conn.receiveError(err)
+            return
+        }
+        if conn.started {
+            if err := afterStart(msg); err != nil {
+                conn.Deny(err)
+                return
+            }
+        }
+        for _, input := range msg.Input {
+            var err error
+            switch {
+            case input.Stream != nil:
+                if input.Blob == nil {
+                    err = reply.Error("'input' must specify a 'blob'")
+                    break
+                }
+                err = conn.writeInput(input.Stream, blobs[*input.Blob])
+            case input.Filename == nil:
+                err = reply.Error("'input' must specify a 'filename'")
+            case input.Restore != nil && *input.Restore:
+                if input.Blob != nil {
+                    err = reply.Error(
+                        "'input' with 'restore' cannot have a 'blob'")
+                    break
+                }
+                err = conn.restoreFile(*input.Filename, input.Hash)
+            case input.Blob == nil:
+                err = reply.Error("'input' must specify a 'blob'")
+            default:
+                err = conn.addFile(
+                    *input.Filename, input.Hash, blobs[*input.Blob])
+            }
+            if err != nil {
+                conn.Deny(err)
+                return
+            }
+        }
+        if msg.Options != nil {
+            err := conn.setOptions(msg.Options)
+            if err != nil {
+                conn.Deny(err)
+                return
+            }
+        }
+        if msg.Start != nil {
+            err := conn.start(msg.Start)
+            if err != nil {
+                conn.Deny(err)
+                return
+            }
+        }
+    }
+}
+
+// afterStart checks that a message received after "start" only updates
+// the duration, or writes to stdin in interactive mode
+func afterStart(msg *message.Message) error {
+    for _, input := range msg.Input {
+        if input.Stream == nil {
+            return reply.Error(
+                "The task has already started, cannot add files")
+        }
+    }
+    if o := msg.Options; o != nil &&
+        (o.Format != nil || o.StderrRedir != nil || o.Verbosity != nil) {
+        return reply.Error("The task has already started, " +
+            "only 'options.duration' can be set")
+    }
+    if msg.Start != nil {
+        return reply.Error("The task has already started, cannot start again")
+    }
+    return nil
+}
+
+func (conn *Conn) addFile(filename string, hash *string, contents []byte,
+) error {
+    // sync: receive loop
+    // XXX check for total file size
+    if hash != nil && conn.cache != nil {
+        if !checkHash(*hash) {
+            return reply.Error("'hash' must be a SHA-256 hex digest")
+        }
+        if hashOf(contents) != strings.ToLower(*hash) {
+            return reply.Error("'hash' does not match the file contents")
+        }
+        conn.cache.Store(strings.ToLower(*hash), contents)
+    }
+    return conn.task.AddFile(filename, contents)
+}
+
+func (conn *Conn) restoreFile(filename string, hash *string) error {
+    // sync: receive loop
+    if conn.cache == nil {
+        return reply.Error("'restore' not enabled")
+    }
+    if hash == nil {
+        return reply.Error("'restore' requires a 'hash'")
+    }
+    if !checkHash(*hash) {
+        return reply.Error("'hash' must be a SHA-256 hex digest")
+    }
+    contents, ok := conn.cache.Load(strings.ToLower(*hash))
+    if !ok {
+        conn.missing = append(conn.missing, message.File{
+            Filename: filename,
+            Hash:     strings.ToLower(*hash),
+        })
+        return nil
+    }
+    return conn.task.AddFile(filename, contents)
+}
+
+func (conn *Conn) writeInput(stream *string, contents []byte) error {
+    // sync: receive loop
+    if conn.itask == nil {
+        return reply.Error("'input' is only allowed in interactive mode")
+    }
+    if stream == nil || *stream != "stdin" {
+        return reply.Error("'stream' can only be \"stdin\"")
+    }
+    return conn.itask.WriteStdin(contents)
+}
+
+func (conn *Conn) setOptions(options *message.Options) error {
+    // sync: receive loop
+    return setOptions(conn.task, options)
+}
+
+// setOptions passes the options that are set to t
+func setOptions(t task, options *message.Options) error {
+    var err error
+    if options.Duration != nil {
+        err = t.SetDuration(*options.Duration)
+        if err != nil {
+            return err
+        }
+    }
+    if options.Format != nil {
+        err = t.SetFormat(*options.Format)
+        if err != nil {
+            return err
+        }
+    }
+    if options.StderrRedir != nil {
+        err = t.SetStderrRedir(*options.StderrRedir)
+        if err != nil {
+            return err
+        }
+    }
+    if options.Verbosity != nil {
+        err = t.SetVerbosity(*options.Verbosity)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+func (conn *Conn) start(start *message.Start) error {
+    // sync: receive loop
+    var mainname string
+    switch {
+    case conn.interactive:
+        // main filename is ignored
+    case start.Main == nil:
+        return reply.Error("'start' must specify a 'main' filename")
+    default:
+        mainname = *start.Main
+    }
+    if len(conn.missing) > 0 {
+        if conn.missingSent {
+            return reply.Error("Some files could not be restored")
+        }
+        err := conn.sendMissing(conn.missing)
+        if err != nil {
+            return err
+        }
+        // back to stage 1
+        conn.missingSent = true
+        conn.missing = nil
+        return nil
+    }
+    if err := conn.task.Start(mainname); err != nil {
+        return err
+    }
+    conn.started = true
+    return nil
+}
+
+func checkHash(hash string) bool {
+    if len(hash) != 64 {
+        return false
+    }
+    for _, c := range hash {
+        switch {
+        case '0' <= c && c <= '9':
+        case 'a' <= c && c <= 'f':
+        case 'A' <= c && c <= 'F':
+        default:
+            return false
+        }
+    }
+    return true
+}
+
+func hashOf(contents []byte) string {
+    sum := sha256.Sum256(contents)
+    return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,398 @@
+package server
+
+import (
+    "crypto/rand"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "io/fs"
+    "log"
+    "net/http"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+    "time"
+
+    "asyonline/server/server/message"
+)
+
+// JobsPath is the path of the job API, see plan-proto.md
+const JobsPath = "/asy/jobs"
+
+// the job directory is swept for expired jobs this often
+const sweepInterval time.Duration = 60e9 // 1min
+
+// maximum number of jobs that did not stop, in all and of one client
+const (
+    maxJobs          = 1000
+    maxJobsPerClient = 20
+)
+
+// statuses of jobs
+const (
+    jobQueued  = "queued"
+    jobRunning = "running"
+    jobDone    = "done"
+    jobFailed  = "failed"
+)
+
+// Jobs runs tasks submitted to the job API in the background,
+// regardless of connections of clients, and keeps their outcomes in
+// a directory until they expire
+type Jobs struct {
+    dir string
+    ttl time.Duration
+
+    mutex sync.Mutex
+    // jobs that are not stored yet, by IDs
+    active map[string]*Job
+}
+
+// NewJobs creates dir unless it exists, fails the jobs in it that did
+// not stop before a restart, and starts removing jobs older than ttl
+// from it
+func NewJobs(dir string, ttl time.Duration) (*Jobs, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    jobs := &Jobs{
+        dir:    dir,
+        ttl:    ttl,
+        active: make(map[string]*Job),
+    }
+    if err := jobs.failLost(); err != nil {
+        return nil, err
+    }
+    go jobs.sweepLoop()
+    return jobs, nil
+}
+
+// failLost marks jobs that are still queued or running in the job
+// directory as failed, as their tasks were lost with the previous run
+func (jobs *Jobs) failLost() error {
+    paths, err := filepath.Glob(filepath.Join(jobs.dir, "*.json"))
+    if err != nil {
+        return err
+    }
+    for _, path := range paths {
+        statusB, err := os.ReadFile(path)
+        if err != nil {
+            return err
+        }
+        var status jobStatus
+        if err := json.Unmarshal(statusB, &status); err != nil {
+            log.Printf("%s: %v", path, err)
+            continue
+        }
+        if status.Status == jobDone || status.Status == jobFailed {
+            continue
+        }
+        lost := &jobStatus{ID: status.ID, Status: jobFailed,
+            Error: "The job was lost in a restart of the server, submit " +
+                "it again"}
+        if err := writeStatus(path, lost); err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Job is a task of the job API. It takes the same sender methods
+// as Conn.
+type Job struct {
+    collector
+    id    string
+    s     *submission
+    queue *message.QueueStatus
+}
+
+// jobStatus is the response to status requests of a job, and is stored
+// as "<ID>.json" in the job directory with the result in "<ID>.result".
+// Jobs that did not stop are stored as queued, to be failed on restart.
+type jobStatus struct {
+    ID     string               `json:"id"`
+    Status string               `json:"status"`
+    Queue  *message.QueueStatus `json:"queue,omitempty"`
+    Format string               `json:"format,omitempty"`
+    Error  string               `json:"error,omitempty"`
+    Busy   *message.Busy        `json:"busy,omitempty"`
+    Output []CompileOutput      `json:"output,omitempty"`
+}
+
+// Client identifies the client by its IP address
+func (j *Job) Client() string {
+    return j.s.client
+}
+
+// HandleWith passes the files and options of the job to t and starts it
+func (j *Job) HandleWith(t task) {
+    if err := j.s.start(t); err != nil {
+        j.Deny(err)
+    }
+}
+
+// SendStatus keeps the queue status for status requests
+func (j *Job) SendStatus(status *message.Status) error {
+    j.mutex.Lock()
+    defer j.mutex.Unlock()
+    if status.Queue != nil {
+        j.queue = status.Queue
+    }
+    return nil
+}
+
+func (j *Job) status() *jobStatus {
+    j.mutex.Lock()
+    if j.done {
+        j.mutex.Unlock()
+        return j.outcome()
+    }
+    defer j.mutex.Unlock()
+    status := &jobStatus{ID: j.id, Status: jobQueued, Queue: j.queue}
+    if j.started {
+        status.Status, status.Queue = jobRunning, nil
+        status.Output = append([]CompileOutput(nil), j.output...)
+    }
+    return status
+}
+
+// outcome returns the status of a job that is done. The collector does
+// not change anymore then.
+func (j *Job) outcome() *jobStatus {
+    status := &jobStatus{ID: j.id, Status: jobDone, Format: j.format}
+    if j.err == nil {
+        status.Output = j.output
+        return status
+    }
+    f, _ := j.failure()
+    status.Status, status.Format = jobFailed, ""
+    status.Error, status.Busy, status.Output = f.Error, f.Busy, f.Output
+    return status
+}
+
+// Handler serves the job API at JobsPath. run runs the task of a job
+// with its sender methods, and returns when either stops.
+func (jobs *Jobs) Handler(run func(job *Job)) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        path := strings.Trim(strings.TrimPrefix(r.URL.Path, JobsPath), "/")
+        switch id, result := strings.CutSuffix(path, "/result"); {
+        case path == "":
+            jobs.submit(w, r, run)
+        case r.Method != http.MethodGet:
+            writeJSON(w, &failure{Error: "Job requests must be GET"},
+                http.StatusMethodNotAllowed)
+        case result:
+            jobs.serveResult(w, id)
+        default:
+            jobs.serveStatus(w, path)
+        }
+    })
+}
+
+func (jobs *Jobs) submit(w http.ResponseWriter, r *http.Request,
+    run func(job *Job),
+) {
+    s, err := readSubmission(w, r)
+    if err != nil {
+        c := newCollector()
+        c.Deny(err)
+        c.writeFailure(w)
+        return
+    }
+    var idB [16]byte
+    if _, err := rand.Read(idB[:]); err != nil {
+        log.Print(err)
+        writeJSON(w, &failure{Error: "Server error"},
+            http.StatusInternalServerError)
+        return
+    }
+    j := &Job{
+        collector: newCollector(),
+        id:        hex.EncodeToString(idB[:]),
+        s:         s,
+    }
+    if f, status := jobs.add(j); f != nil {
+        writeJSON(w, f, status)
+        return
+    }
+    if err := writeStatus(jobs.path(j.id, ".json"), j.status()); err != nil {
+        log.Print(err)
+        jobs.remove(j)
+        writeJSON(w, &failure{Error: "Server error"},
+            http.StatusInternalServerError)
+        return
+    }
+    go func() {
+        run(j)
+        j.interrupt()
+        jobs.store(j)
+    }()
+    w.Header().Set("Location", JobsPath+"/"+j.id)
+    writeJSON(w, j.status(), http.StatusAccepted)
+}
+
+// add makes j active, unless there are too many active jobs in all
+// or of its client. Then it returns the failure to respond with.
+func (jobs *Jobs) add(j *Job) (*failure, int) {
+    jobs.mutex.Lock()
+    defer jobs.mutex.Unlock()
+    if len(jobs.active) >= maxJobs {
+        return &failure{Error: "The server has too many jobs, try later"},
+            http.StatusServiceUnavailable
+    }
+    n := 0
+    for _, other := range jobs.active {
+        if other.s.client == j.s.client {
+            n++
+        }
+    }
+    if n >= maxJobsPerClient {
+        return &failure{Error: "You have too many jobs, wait for them " +
+            "to finish"}, http.StatusTooManyRequests
+    }
+    jobs.active[j.id] = j
+    return nil, 0
+}
+
+func (jobs *Jobs) remove(j *Job) {
+    jobs.mutex.Lock()
+    defer jobs.mutex.Unlock()
+    delete(jobs.active, j.id)
+}
+
+// store writes the outcome of a job to the job directory
+func (jobs *Jobs) store(j *Job) {
+    defer jobs.remove(j)
+    status := j.outcome()
+    // the status is written last, as jobs are known by it
+    if status.Status == jobDone {
+        err := writeFile(jobs.path(j.id, ".result"), j.result)
+        if err != nil {
+            log.Print(err)
+            status = &jobStatus{ID: j.id, Status: jobFailed,
+                Error: "Server error"}
+        }
+    }
+    if err := writeStatus(jobs.path(j.id, ".json"), status); err != nil {
+        log.Print(err)
+    }
+}
+
+// writeStatus writes the status of a job as JSON
+func writeStatus(path string, status *jobStatus) error {
+    statusB, err := json.Marshal(status)
+    if err != nil {
+        return err
+    }
+    return writeFile(path, statusB)
+}
+
+// writeFile writes a file at once, through a temporary file
+func writeFile(path string, contents []byte) error {
+    tmp := path + ".tmp"
+    if err := os.WriteFile(tmp, contents, 0o644); err != nil {
+        return err
+    }
+    return os.Rename(tmp, path)
+}
+
+func (jobs *Jobs) path(id, ext string) string {
+    return filepath.Join(jobs.dir, id+ext)
+}
+
+// find returns the status of a job, and its result if it is done.
+// The status is nil if the job is unknown.
+func (jobs *Jobs) find(id string) (*jobStatus, []byte) {
+    if !checkJobID(id) {
+        return nil, nil
+    }
+    jobs.mutex.Lock()
+    j := jobs.active[id]
+    jobs.mutex.Unlock()
+    if j != nil {
+        status := j.status()
+        if status.Status == jobDone {
+            return status, j.result
+        }
+        return status, nil
+    }
+    statusB, err := os.ReadFile(jobs.path(id, ".json"))
+    if err != nil {
+        if !errors.Is(err, fs.ErrNotExist) {
+            log.Print(err)
+        }
+        return nil, nil
+    }
+    var status jobStatus
+    if err := json.Unmarshal(statusB, &status); err != nil {
+        log.Print(err)
+        return nil, nil
+    }
+    if status.Status != jobDone {
+        return &status, nil
+    }
+    result, err := os.ReadFile(jobs.path(id, ".result"))
+    if err != nil {
+        // expired meanwhile
+        log.Print(err)
+        return nil, nil
+    }
+    return &status, result
+}
+
+func checkJobID(id string) bool {
+    if len(id) != 32 {
+        return false
+    }
+    _, err := hex.DecodeString(id)
+    return err == nil
+}
+
+var errUnknownJob = &failure{Error: "Unknown job"}
+
+func (jobs *Jobs) serveStatus(w http.ResponseWriter, id string) {
+    status, _ := jobs.find(id)
+    if status == nil {
+        writeJSON(w, errUnknownJob, http.StatusNotFound)
+        return
+    }
+    writeJSON(w, status, http.StatusOK)
+}
+
+func (jobs *Jobs) serveResult(w http.ResponseWriter, id string) {
+    status, result := jobs.find(id)
+    switch {
+    case status == nil:
+        writeJSON(w, errUnknownJob, http.StatusNotFound)
+    case status.Status != jobDone:
+        writeJSON(w, &failure{Error: "The job has no result"},
+            http.StatusConflict)
+    default:
+        setOutputHeaders(w, contentType(status.Format))
+        if _, err := w.Write(result); err != nil {
+            log.Print(err)
+        }
+    }
+}
+
+// sweepLoop removes files of expired jobs
+func (jobs *Jobs) sweepLoop() {
+    for {
+        entries, err := os.ReadDir(jobs.dir)
+        if err != nil {
+            log.Print(err)
+        }
+        for _, entry := range entries {
+            info, err := entry.Info()
+            if err != nil || time.Since(info.ModTime()) < jobs.ttl {
+                continue
+            }
+            err = os.Remove(filepath.Join(jobs.dir, entry.Name()))
+            if err != nil && !errors.Is(err, fs.ErrNotExist) {
+                log.Print(err)
+            }
+        }
+        time.Sleep(sweepInterval)
+    }
+}
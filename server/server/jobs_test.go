@@ -0,0 +1,189 @@
+package server
+
+import (
+    "encoding/json"
+    "net/http"
+    "net/http/httptest"
+    "os"
+    "path/filepath"
+    "strconv"
+    "testing"
+    "time"
+)
+
+// newTestJobs returns jobs that run until release is closed,
+// and then succeed
+func newTestJobs(tb testing.TB, dir string,
+) (*Jobs, http.Handler, chan void) {
+    tb.Helper()
+    jobs, err := NewJobs(dir, time.Hour)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    release := make(chan void)
+    h := jobs.Handler(func(job *Job) {
+        job.SendOutput("stdout", nil)
+        <-release
+        job.SendResult("svg", []byte("<svg/>"))
+        job.Complete(nil)
+    })
+    tb.Cleanup(func() {
+        select {
+        case <-release:
+        default:
+            close(release)
+        }
+        // the jobs are stored before the directory is removed
+        deadline := time.Now().Add(5 * time.Second)
+        for {
+            jobs.mutex.Lock()
+            n := len(jobs.active)
+            jobs.mutex.Unlock()
+            if n == 0 || time.Now().After(deadline) {
+                return
+            }
+            time.Sleep(time.Millisecond)
+        }
+    })
+    return jobs, h, release
+}
+
+func submitJob(tb testing.TB, h http.Handler, client string,
+) *httptest.ResponseRecorder {
+    req := compileRequest(tb, JobsPath, nil, "main.asy")
+    req.RemoteAddr = client + ":1234"
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, req)
+    return w
+}
+
+func getJob(h http.Handler, path string) (*httptest.ResponseRecorder,
+    *jobStatus,
+) {
+    w := httptest.NewRecorder()
+    h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+    var status jobStatus
+    json.Unmarshal(w.Body.Bytes(), &status)
+    return w, &status
+}
+
+func TestJob(t *testing.T) {
+    _, h, release := newTestJobs(t, t.TempDir())
+    w := submitJob(t, h, "192.0.2.1")
+    if w.Code != http.StatusAccepted {
+        t.Fatalf("status %d: %s", w.Code, w.Body.String())
+    }
+    location := w.Header().Get("Location")
+    if _, status := getJob(h, location); status.Status != jobRunning &&
+        status.Status != jobQueued {
+        t.Errorf("status %q before the job is done", status.Status)
+    }
+    if w, _ := getJob(h, location+"/result"); w.Code != http.StatusConflict {
+        t.Errorf("result status %d before the job is done", w.Code)
+    }
+    close(release)
+    deadline := time.Now().Add(5 * time.Second)
+    for {
+        _, status := getJob(h, location)
+        if status.Status == jobDone {
+            break
+        }
+        if time.Now().After(deadline) {
+            t.Fatalf("status %q, expected done", status.Status)
+        }
+        time.Sleep(time.Millisecond)
+    }
+    w, _ = getJob(h, location+"/result")
+    if w.Code != http.StatusOK || w.Body.String() != "<svg/>" {
+        t.Errorf("result status %d, body %q", w.Code, w.Body.String())
+    }
+    if w.Header().Get("Content-Type") != "image/svg+xml" ||
+        w.Header().Get("Content-Security-Policy") != outputPolicy ||
+        w.Header().Get("X-Content-Type-Options") != "nosniff" {
+        t.Errorf("result headers %v", w.Header())
+    }
+}
+
+func TestJobsPerClient(t *testing.T) {
+    _, h, _ := newTestJobs(t, t.TempDir())
+    for i := 0; i < maxJobsPerClient; i++ {
+        if w := submitJob(t, h, "192.0.2.1"); w.Code != http.StatusAccepted {
+            t.Fatalf("job %d: status %d", i, w.Code)
+        }
+    }
+    w := submitJob(t, h, "192.0.2.1")
+    if w.Code != http.StatusTooManyRequests {
+        t.Errorf("status %d over the limit of a client, expected 429",
+            w.Code)
+    }
+    if w := submitJob(t, h, "192.0.2.2"); w.Code != http.StatusAccepted {
+        t.Errorf("status %d of another client, expected 202", w.Code)
+    }
+}
+
+func TestJobsTotal(t *testing.T) {
+    jobs, h, _ := newTestJobs(t, t.TempDir())
+    // jobs of other clients
+    jobs.mutex.Lock()
+    for i := 0; i < maxJobs; i++ {
+        id := strconv.Itoa(i)
+        jobs.active[id] = &Job{id: id, s: &submission{client: id}}
+    }
+    jobs.mutex.Unlock()
+    w := submitJob(t, h, "192.0.2.1")
+    if w.Code != http.StatusServiceUnavailable {
+        t.Errorf("status %d over the total limit, expected 503", w.Code)
+    }
+    jobs.mutex.Lock()
+    for i := 0; i < maxJobs; i++ {
+        delete(jobs.active, strconv.Itoa(i))
+    }
+    jobs.mutex.Unlock()
+}
+
+func TestJobsLostOnRestart(t *testing.T) {
+    dir := t.TempDir()
+    ids := map[string]string{
+        "00000000000000000000000000000001": jobQueued,
+        "00000000000000000000000000000002": jobRunning,
+        "00000000000000000000000000000003": jobFailed,
+    }
+    for id, status := range ids {
+        statusB, _ := json.Marshal(&jobStatus{ID: id, Status: status,
+            Error: "Execution failed"})
+        err := os.WriteFile(filepath.Join(dir, id+".json"), statusB, 0o644)
+        if err != nil {
+            t.Fatal(err)
+        }
+    }
+    _, h, _ := newTestJobs(t, dir)
+    for id, before := range ids {
+        w, status := getJob(h, JobsPath+"/"+id)
+        if w.Code != http.StatusOK || status.Status != jobFailed {
+            t.Errorf("%s job: status %d, %q after a restart", before,
+                w.Code, status.Status)
+        }
+        if before == jobFailed && status.Error != "Execution failed" {
+            t.Errorf("failed job: error %q after a restart", status.Error)
+        }
+    }
+}
+
+func TestUnknownJobs(t *testing.T) {
+    _, h, _ := newTestJobs(t, t.TempDir())
+    for _, id := range []string{
+        "x",
+        "..",
+        "%2e%2e%2fjobs",
+        "0000000000000000000000000000000g",
+        "00000000000000000000000000000001",
+    } {
+        if w, _ := getJob(h, JobsPath+"/"+id); w.Code != http.StatusNotFound {
+            t.Errorf("%q: status %d, expected 404", id, w.Code)
+        }
+        w, _ := getJob(h, JobsPath+"/"+id+"/result")
+        if w.Code != http.StatusNotFound {
+            t.Errorf("%q result: status %d, expected 404", id, w.Code)
+        }
+    }
+}
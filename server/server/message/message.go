@@ -0,0 +1,146 @@
+// Package message implements framing of the JSON protocol
+// (see "JSON TODO" in plan-proto.md): every message is a JSON object,
+// optionally followed by binary messages referenced by "blob" indices.
+package message
+
+import (
+    "encoding/json"
+    "fmt"
+
+    "golang.org/x/net/websocket"
+
+    "asyonline/server/server/reply"
+)
+
+type Message struct {
+    Input   []Input  `json:"input,omitempty"`
+    Options *Options `json:"options,omitempty"`
+    Start   *Start   `json:"start,omitempty"`
+    Missing []File   `json:"missing,omitempty"`
+    Output  []Output `json:"output,omitempty"`
+    Status  *Status  `json:"status,omitempty"`
+    Ok      int      `json:"ok,omitempty"`
+    Error   *string  `json:"error,omitempty"`
+    // sent with "error" when the task was denied for lack of capacity
+    Busy *Busy `json:"busy,omitempty"`
+}
+
+type Input struct {
+    Filename *string `json:"filename,omitempty"`
+    Hash     *string `json:"hash,omitempty"`
+    Restore  *bool   `json:"restore,omitempty"`
+    Stream   *string `json:"stream,omitempty"`
+    Blob     *int    `json:"blob,omitempty"`
+}
+
+type Options struct {
+    Duration    *float64 `json:"duration,omitempty"`
+    Format      *string  `json:"format,omitempty"`
+    StderrRedir *bool    `json:"stderrRedir,omitempty"`
+    Verbosity   *int     `json:"verbosity,omitempty"`
+}
+
+type Start struct {
+    Main *string `json:"main,omitempty"`
+}
+
+type File struct {
+    Filename string `json:"filename"`
+    Hash     string `json:"hash"`
+}
+
+type Output struct {
+    Format string `json:"format,omitempty"`
+    Stream string `json:"stream,omitempty"`
+    Blob   *int   `json:"blob,omitempty"`
+}
+
+type Status struct {
+    Queue        *QueueStatus `json:"queue,omitempty"`
+    Announcement string       `json:"announcement,omitempty"`
+}
+
+type Busy struct {
+    // seconds
+    RetryAfter float64 `json:"retryAfter"`
+}
+
+type QueueStatus struct {
+    // seconds
+    Estimate float64 `json:"estimate"`
+    // 1 for the first waiting task
+    Position int `json:"position"`
+}
+
+// Blob returns a pointer to i, to be used as a "blob" index.
+func Blob(i int) *int {
+    return &i
+}
+
+func (msg *Message) blobs() []*int {
+    var blobs []*int
+    for _, input := range msg.Input {
+        if input.Blob != nil {
+            blobs = append(blobs, input.Blob)
+        }
+    }
+    for _, output := range msg.Output {
+        if output.Blob != nil {
+            blobs = append(blobs, output.Blob)
+        }
+    }
+    return blobs
+}
+
+// Send sends msg followed by blobs.
+// Blob indices in msg must correspond to the blobs.
+func Send(ws *websocket.Conn, msg *Message, blobs ...[]byte) error {
+    msgB, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    err = websocket.Message.Send(ws, string(msgB))
+    if err != nil {
+        return err
+    }
+    for _, blob := range blobs {
+        err = websocket.Message.Send(ws, blob)
+        if err != nil {
+            return err
+        }
+    }
+    return nil
+}
+
+// Receive receives a message and all the binary messages that follow it.
+// Errors of type reply.Error indicate a malformed message.
+func Receive(ws *websocket.Conn) (*Message, [][]byte, error) {
+    var msgB []byte
+    err := websocket.Message.Receive(ws, &msgB)
+    if err != nil {
+        return nil, nil, err
+    }
+    var msg Message
+    err = json.Unmarshal(msgB, &msg)
+    if err != nil {
+        return nil, nil, reply.Error("message is not a correct JSON object")
+    }
+    indices := msg.blobs()
+    seen := make([]bool, len(indices))
+    for _, i := range indices {
+        if *i < 0 || *i >= len(indices) || seen[*i] {
+            return nil, nil, reply.Error(fmt.Sprintf(
+                "'blob' indices must be distinct and less than %d",
+                len(indices)))
+        }
+        seen[*i] = true
+    }
+    blobs := make([][]byte, len(indices))
+    for i := range blobs {
+        err = websocket.Message.Receive(ws, &blobs[i])
+        if err != nil {
+            return nil, nil, err
+        }
+    }
+    return &msg, blobs, nil
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+    "errors"
+    "net/http"
+    "strings"
+
+    "golang.org/x/net/websocket"
+)
+
+// websocket sub-protocols, see plan-proto.md
+const (
+    ProtocolAsy        = "asyonline.asy"
+    ProtocolAsyRestore = "asyonline.asy+restore"
+    // same as above, with pure JSON framing
+    ProtocolJSONAsy        = "asyonline.json.asy"
+    ProtocolJSONAsyRestore = "asyonline.json.asy+restore"
+)
+
+// websocket sub-protocols at "/asy/interactive"
+const (
+    ProtocolAsyInteractive            = "asyonline.asy.interactive"
+    ProtocolAsyInteractiveRestore     = "asyonline.asy.interactive+restore"
+    ProtocolJSONAsyInteractive        = "asyonline.json.asy.interactive"
+    ProtocolJSONAsyInteractiveRestore = "asyonline.json.asy.interactive+restore"
+)
+
+const (
+    jsonPrefix       = "asyonline.json."
+    restoreSuffix    = "+restore"
+    interactiveInfix = ".interactive"
+)
+
+// Handshake returns a websocket handshake function that accepts the first
+// of the client sub-protocols that is listed in protocols. A client that
+// offers no sub-protocols gets the first of protocols.
+//
+// Client sub-protocols are read from the request, since websocket.Server
+// appends them to its own Config.Protocol.
+func Handshake(protocols ...string,
+) func(config *websocket.Config, req *http.Request) error {
+    return func(config *websocket.Config, req *http.Request) error {
+        // XXX check origin?
+        offered := strings.TrimSpace(req.Header.Get("Sec-Websocket-Protocol"))
+        if offered == "" && len(protocols) > 0 {
+            config.Protocol = []string{protocols[0]}
+            return nil
+        }
+        for _, protocol := range strings.Split(offered, ",") {
+            protocol = strings.TrimSpace(protocol)
+            for _, supported := range protocols {
+                if protocol == supported {
+                    config.Protocol = []string{protocol}
+                    return nil
+                }
+            }
+        }
+        return errors.New("unknown websocket sub-protocols")
+    }
+}
+
+func negotiated(ws *websocket.Conn) string {
+    config := ws.Config()
+    if config == nil || len(config.Protocol) == 0 {
+        return ""
+    }
+    return config.Protocol[0]
+}
+
+func hasRestore(protocol string) bool {
+    return strings.HasSuffix(protocol, restoreSuffix)
+}
+
+func hasJSON(protocol string) bool {
+    return strings.HasPrefix(protocol, jsonPrefix)
+}
+
+func hasInteractive(protocol string) bool {
+    return strings.Contains(protocol, interactiveInfix)
+}
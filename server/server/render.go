@@ -0,0 +1,133 @@
+package server
+
+import (
+    "encoding/base64"
+    "net/http"
+    "strconv"
+    "strings"
+
+    "asyonline/server/server/reply"
+    "asyonline/server/server/results"
+)
+
+// RenderPath is the path of the render API, followed by ".<format>",
+// see plan-proto.md
+const RenderPath = "/asy/render"
+
+// filename of the source of a rendering
+const snippetFilename = "snippet.asy"
+
+// maximum age of rendered images in caches of clients, seconds
+const renderMaxAge = 86400 // 1 day
+
+// Rendering runs a task for a GET request of the render API, which
+// compiles a source file given in the URL. Images are kept in a cache
+// by the key of the task in a result store (see results.Key), which
+// includes the versions of asy and TeX, and responses may be cached by
+// clients too, if the versions are known. A Rendering stops right away
+// if the image is known.
+type Rendering struct {
+    Compilation
+    images cache
+    // results.Key of the task
+    key string
+    // the versions are known, so that clients may keep the image
+    cacheable bool
+    // the client has the image already
+    notModified bool
+}
+
+// NewRendering reads the source and the format of the request, and
+// looks for the image in images. version identifies asy and TeX.
+func NewRendering(w http.ResponseWriter, req *http.Request,
+    images cache, version string,
+) *Rendering {
+    r := &Rendering{
+        Compilation: Compilation{
+            collector: newCollector(),
+            w:         w,
+            req:       req,
+        },
+        images:    images,
+        cacheable: version != "",
+    }
+    var err error
+    r.s, err = readSnippet(req)
+    if err != nil {
+        r.Deny(err)
+        return r
+    }
+    format := *r.s.options.Format
+    r.key = results.Key(version, r.s.files, snippetFilename, format, 0, false)
+    if r.cacheable &&
+        strings.Contains(req.Header.Get("If-None-Match"), r.etag()) {
+        r.notModified = true
+        r.Stop()
+        return r
+    }
+    if result, ok := images.Load(r.key); ok {
+        r.SendResult(format, result)
+        r.Complete(nil)
+    }
+    return r
+}
+
+// readSnippet reads the query of a GET request, with the format given
+// by the extension of the path
+func readSnippet(req *http.Request) (*submission, error) {
+    s := &submission{
+        files:  make(map[string][]byte),
+        main:   snippetFilename,
+        client: clientOf(req),
+    }
+    if req.Method != http.MethodGet && req.Method != http.MethodHead {
+        return s, reply.Error("Render requests must be GET")
+    }
+    format := strings.TrimPrefix(req.URL.Path, RenderPath+".")
+    if format == req.URL.Path {
+        return s, reply.Error("The path must end with the format")
+    }
+    s.options.Format = &format
+    src, err := base64.RawURLEncoding.DecodeString(
+        strings.TrimRight(req.URL.Query().Get("src"), "="))
+    if err != nil {
+        return s, reply.Error("'src' must be a base64url-encoded source")
+    }
+    if len(src) == 0 {
+        return s, reply.Error("'src' must be set")
+    }
+    if len(src) > maxCompileSize {
+        return s, reply.Error("The source is too large")
+    }
+    s.files[snippetFilename] = src
+    return s, nil
+}
+
+func (r *Rendering) etag() string {
+    return `"` + r.key + `"`
+}
+
+// Close writes the response, and keeps the image in the cache of
+// results. The rendering must be stopped.
+func (r *Rendering) Close() {
+    header := r.w.Header()
+    if r.notModified {
+        header.Set("ETag", r.etag())
+        header.Set("Cache-Control", cacheControl)
+        r.w.WriteHeader(http.StatusNotModified)
+        return
+    }
+    r.interrupt()
+    if r.err == nil {
+        r.images.Store(r.key, r.result)
+    }
+    if r.err == nil && r.cacheable {
+        header.Set("ETag", r.etag())
+        header.Set("Cache-Control", cacheControl)
+    } else {
+        header.Set("Cache-Control", "no-store")
+    }
+    r.Compilation.Close()
+}
+
+var cacheControl = "public, max-age=" + strconv.Itoa(renderMaxAge)
@@ -0,0 +1,90 @@
+package server
+
+import (
+    "encoding/base64"
+    "net/http"
+    "net/http/httptest"
+    "sync"
+    "testing"
+
+    "asyonline/server/server/results"
+)
+
+// fakeCache keeps images in a map
+type fakeCache struct {
+    mutex  sync.Mutex
+    images map[string][]byte
+}
+
+func (c *fakeCache) Store(hash string, contents []byte) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    c.images[hash] = contents
+}
+
+func (c *fakeCache) Load(hash string) ([]byte, bool) {
+    c.mutex.Lock()
+    defer c.mutex.Unlock()
+    contents, ok := c.images[hash]
+    return contents, ok
+}
+
+var snippet = []byte("draw((0,0)--(1,1));")
+
+func snippetKey(version string) string {
+    return results.Key(version, map[string][]byte{snippetFilename: snippet},
+        snippetFilename, "svg", 0, false)
+}
+
+// render serves a request for a snippet whose image is known
+func render(version, etag string) *httptest.ResponseRecorder {
+    key := snippetKey(version)
+    images := &fakeCache{images: map[string][]byte{key: []byte("<svg/>")}}
+    req := httptest.NewRequest(http.MethodGet, RenderPath+".svg?src="+
+        base64.RawURLEncoding.EncodeToString(snippet), nil)
+    if etag != "" {
+        req.Header.Set("If-None-Match", etag)
+    }
+    w := httptest.NewRecorder()
+    r := NewRendering(w, req, images, version)
+    <-r.Stopped
+    r.Close()
+    return w
+}
+
+func TestRenderCaching(t *testing.T) {
+    w := render("asy 2.86", "")
+    etag := w.Header().Get("ETag")
+    if w.Code != http.StatusOK || w.Body.String() != "<svg/>" {
+        t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+    }
+    if etag == "" || w.Header().Get("Cache-Control") != cacheControl {
+        t.Errorf("ETag %q, Cache-Control %q", etag,
+            w.Header().Get("Cache-Control"))
+    }
+    if w.Header().Get("Content-Security-Policy") != outputPolicy {
+        t.Error("no Content-Security-Policy")
+    }
+    if w := render("asy 2.86", etag); w.Code != http.StatusNotModified {
+        t.Errorf("status %d with the ETag, expected 304", w.Code)
+    }
+    if w := render("asy 2.87", etag); w.Code != http.StatusOK ||
+        w.Header().Get("ETag") == etag {
+        t.Errorf("status %d, ETag %q after an upgrade", w.Code,
+            w.Header().Get("ETag"))
+    }
+}
+
+func TestRenderWithoutVersion(t *testing.T) {
+    // the ETag that the image would have, if it had one
+    w := render("", `"`+snippetKey("")+`"`)
+    if w.Code != http.StatusOK || w.Body.String() != "<svg/>" {
+        t.Fatalf("status %d, body %q", w.Code, w.Body.String())
+    }
+    if etag := w.Header().Get("ETag"); etag != "" {
+        t.Errorf("ETag %q without a version", etag)
+    }
+    if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+        t.Errorf("Cache-Control %q without a version", cc)
+    }
+}
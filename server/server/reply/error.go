@@ -6,3 +6,12 @@ func (err Error) Error() string {
     return string(err)
 }
 
+// Busy denies a task because the server has no free capacity
+type Busy struct {
+    // seconds the client should wait before retrying
+    RetryAfter float64
+}
+
+func (err Busy) Error() string {
+    return "The server is busy, try later"
+}
@@ -0,0 +1,324 @@
+// Package results keeps outcomes of tasks on disk, so that identical
+// tasks are not run again.
+package results
+
+import (
+    "container/list"
+    "crypto/sha256"
+    "encoding/hex"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "log"
+    "os"
+    "path/filepath"
+    "sort"
+    "strings"
+    "sync"
+    "time"
+)
+
+// Sender receives the outcome of a task, like asy.Task's conn
+type Sender interface {
+    SendOutput(stream string, output []byte) error
+    SendResult(format string, contents []byte) error
+    Complete(err error) error
+}
+
+// Outcome is what a task that succeeded sent, in order
+type Outcome struct {
+    Events []Event `json:"events"`
+}
+
+// Event is an output (with Stream) or a result (with Format) of a task.
+// An empty output indicates the start of the process.
+type Event struct {
+    Stream   string `json:"stream,omitempty"`
+    Format   string `json:"format,omitempty"`
+    Contents []byte `json:"contents,omitempty"`
+}
+
+// SendTo sends the output or the result to s
+func (e *Event) SendTo(s Sender) error {
+    if e.Stream != "" {
+        return s.SendOutput(e.Stream, e.Contents)
+    }
+    return s.SendResult(e.Format, e.Contents)
+}
+
+// Replay sends the outcome to s, as if the task ran again
+func (o *Outcome) Replay(s Sender) error {
+    for i := range o.Events {
+        if err := o.Events[i].SendTo(s); err != nil {
+            return err
+        }
+    }
+    return s.Complete(nil)
+}
+
+// Store keeps outcomes of tasks that succeeded in a directory, one file
+// per key (see Key). The least recently used outcomes are removed when
+// their total size exceeds maxSize. The directory must not be shared
+// by several stores.
+type Store struct {
+    dir     string
+    maxSize int64
+    version string
+
+    mutex   sync.Mutex
+    entries map[string]*list.Element
+    order   *list.List // most recently used at front
+    size    int64
+}
+
+type entry struct {
+    key  string
+    size int64
+}
+
+// New creates dir unless it exists, and takes the outcomes kept in it.
+// version identifies asy and TeX, which outcomes depend on.
+func New(dir string, maxSize int64, version string) (*Store, error) {
+    if err := os.MkdirAll(dir, 0o755); err != nil {
+        return nil, err
+    }
+    dirEntries, err := os.ReadDir(dir)
+    if err != nil {
+        return nil, err
+    }
+    var infos []fs.FileInfo
+    for _, dirEntry := range dirEntries {
+        name := dirEntry.Name()
+        if strings.HasSuffix(name, ".tmp") {
+            // left by a crash
+            os.Remove(filepath.Join(dir, name))
+            continue
+        }
+        if !checkKey(name) {
+            continue
+        }
+        info, err := dirEntry.Info()
+        if err != nil {
+            continue
+        }
+        infos = append(infos, info)
+    }
+    // modification times are updated on use
+    sort.Slice(infos, func(i, j int) bool {
+        return infos[i].ModTime().Before(infos[j].ModTime())
+    })
+    s := &Store{
+        dir:     dir,
+        maxSize: maxSize,
+        version: version,
+        entries: make(map[string]*list.Element),
+        order:   list.New(),
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    for _, info := range infos {
+        s.entries[info.Name()] = s.order.PushFront(
+            &entry{key: info.Name(), size: info.Size()})
+        s.size += info.Size()
+    }
+    s.evict()
+    return s, nil
+}
+
+// Key returns the key of the outcome of a task in the store, see Key
+func (s *Store) Key(files map[string][]byte, main string,
+    format string, verbosity int, stderrRedir bool,
+) string {
+    return Key(s.version, files, main, format, verbosity, stderrRedir)
+}
+
+// Key returns a hash of everything that the outcome of a task depends on:
+// the source files, the main file, the options other than duration, and
+// version, which identifies asy and TeX
+func Key(version string, files map[string][]byte, main string,
+    format string, verbosity int, stderrRedir bool,
+) string {
+    filenames := make([]string, 0, len(files))
+    for filename := range files {
+        filenames = append(filenames, filename)
+    }
+    sort.Strings(filenames)
+    h := sha256.New()
+    fmt.Fprintf(h, "version %q\n", version)
+    for _, filename := range filenames {
+        fmt.Fprintf(h, "file %q %d\n", filename, len(files[filename]))
+        h.Write(files[filename])
+    }
+    fmt.Fprintf(h, "main %q format %q verbosity %d stderrRedir %t\n",
+        main, format, verbosity, stderrRedir)
+    return hex.EncodeToString(h.Sum(nil))
+}
+
+func checkKey(key string) bool {
+    if len(key) != 2*sha256.Size {
+        return false
+    }
+    _, err := hex.DecodeString(key)
+    return err == nil
+}
+
+func (s *Store) path(key string) string {
+    return filepath.Join(s.dir, key)
+}
+
+// Load returns the outcome of the given key, if it is kept
+func (s *Store) Load(key string) (*Outcome, bool) {
+    s.mutex.Lock()
+    elem, ok := s.entries[key]
+    if ok {
+        s.order.MoveToFront(elem)
+    }
+    s.mutex.Unlock()
+    if !ok {
+        return nil, false
+    }
+    path := s.path(key)
+    contents, err := os.ReadFile(path)
+    if err != nil {
+        // removed meanwhile unless it is another error
+        if !errors.Is(err, fs.ErrNotExist) {
+            log.Print(err)
+        }
+        s.drop(elem)
+        return nil, false
+    }
+    now := time.Now()
+    if err := os.Chtimes(path, now, now); err != nil {
+        log.Print(err)
+    }
+    var outcome Outcome
+    if err := json.Unmarshal(contents, &outcome); err != nil {
+        log.Printf("%s: %v", path, err)
+        s.drop(elem)
+        return nil, false
+    }
+    return &outcome, true
+}
+
+// drop forgets an outcome that cannot be loaded, unless it was
+// forgotten meanwhile
+func (s *Store) drop(elem *list.Element) {
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    e := elem.Value.(*entry)
+    if s.entries[e.key] == elem {
+        s.remove(elem)
+    }
+}
+
+// store keeps the outcome of the given key, unless it is larger than
+// the store
+func (s *Store) store(key string, outcome *Outcome) {
+    contents, err := json.Marshal(outcome)
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    size := int64(len(contents))
+    if size > s.maxSize {
+        return
+    }
+    // a temporary file per writer, as identical tasks may complete
+    // at the same time
+    file, err := os.CreateTemp(s.dir, "*.tmp")
+    if err != nil {
+        log.Print(err)
+        return
+    }
+    _, err = file.Write(contents)
+    if errx := file.Close(); err == nil {
+        err = errx
+    }
+    if err == nil {
+        err = os.Rename(file.Name(), s.path(key))
+    }
+    if err != nil {
+        log.Print(err)
+        os.Remove(file.Name())
+        return
+    }
+    s.mutex.Lock()
+    defer s.mutex.Unlock()
+    if elem, ok := s.entries[key]; ok {
+        e := elem.Value.(*entry)
+        s.size += size - e.size
+        e.size = size
+        s.order.MoveToFront(elem)
+    } else {
+        s.entries[key] = s.order.PushFront(&entry{key: key, size: size})
+        s.size += size
+    }
+    s.evict()
+}
+
+// sync: s.mutex must be held
+func (s *Store) evict() {
+    for s.size > s.maxSize {
+        s.remove(s.order.Back())
+    }
+}
+
+// remove forgets an outcome and removes its file
+//
+// sync: s.mutex must be held
+func (s *Store) remove(elem *list.Element) {
+    e := elem.Value.(*entry)
+    s.order.Remove(elem)
+    delete(s.entries, e.key)
+    s.size -= e.size
+    err := os.Remove(s.path(e.key))
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        log.Print(err)
+    }
+}
+
+// Recorder passes the outcome of a task to a Sender, and keeps it
+// in a Store if the task succeeds
+type Recorder struct {
+    sender Sender
+    store  *Store
+    key    string
+
+    mutex   sync.Mutex
+    outcome Outcome
+}
+
+func NewRecorder(sender Sender, store *Store, key string) *Recorder {
+    return &Recorder{
+        sender: sender,
+        store:  store,
+        key:    key,
+    }
+}
+
+func (r *Recorder) record(e Event) {
+    r.mutex.Lock()
+    r.outcome.Events = append(r.outcome.Events, e)
+    r.mutex.Unlock()
+}
+
+func (r *Recorder) SendOutput(stream string, output []byte) error {
+    r.record(Event{Stream: stream, Contents: output})
+    return r.sender.SendOutput(stream, output)
+}
+
+func (r *Recorder) SendResult(format string, contents []byte) error {
+    r.record(Event{Format: format, Contents: contents})
+    return r.sender.SendResult(format, contents)
+}
+
+func (r *Recorder) Complete(err error) error {
+    if err == nil {
+        r.mutex.Lock()
+        outcome := r.outcome
+        r.mutex.Unlock()
+        r.store.store(r.key, &outcome)
+    }
+    return r.sender.Complete(err)
+}
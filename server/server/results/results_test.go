@@ -0,0 +1,107 @@
+package results
+
+import (
+    "encoding/json"
+    "os"
+    "testing"
+)
+
+func outcome(text string) *Outcome {
+    return &Outcome{Events: []Event{
+        {Stream: "stdout", Contents: []byte(text)},
+        {Format: "svg", Contents: []byte("<svg/>")},
+    }}
+}
+
+func size(tb testing.TB, o *Outcome) int64 {
+    contents, err := json.Marshal(o)
+    if err != nil {
+        tb.Fatal(err)
+    }
+    return int64(len(contents))
+}
+
+func key(s *Store, source string) string {
+    return s.Key(map[string][]byte{"main.asy": []byte(source)},
+        "main.asy", "svg", 0, false)
+}
+
+func loaded(s *Store, k string) string {
+    o, ok := s.Load(k)
+    if !ok {
+        return ""
+    }
+    return string(o.Events[0].Contents)
+}
+
+func TestStore(t *testing.T) {
+    dir := t.TempDir()
+    // room for two outcomes
+    s, err := New(dir, 2*size(t, outcome("a")), "v1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    a, b, c := key(s, "a"), key(s, "b"), key(s, "c")
+    if _, ok := s.Load(a); ok {
+        t.Error("an outcome that was not stored is loaded")
+    }
+    s.store(a, outcome("a"))
+    s.store(b, outcome("b"))
+    if got := loaded(s, a); got != "a" {
+        t.Errorf("loaded %q, expected a", got)
+    }
+    // b is the least recently used
+    s.store(c, outcome("c"))
+    if _, ok := s.Load(b); ok {
+        t.Error("the least recently used outcome is not evicted")
+    }
+    if _, err := os.Stat(s.path(b)); !os.IsNotExist(err) {
+        t.Errorf("the evicted file is kept: %v", err)
+    }
+    if loaded(s, a) != "a" || loaded(s, c) != "c" {
+        t.Error("recently used outcomes are evicted")
+    }
+    // taken by a store of the same directory
+    reopened, err := New(dir, s.maxSize, "v1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    if loaded(reopened, a) != "a" {
+        t.Error("a kept outcome is not loaded after a restart")
+    }
+    // other versions have other keys
+    if key(reopened, "a") == key(&Store{version: "v2"}, "a") {
+        t.Error("the key does not depend on the version")
+    }
+}
+
+func TestStoreCorrupt(t *testing.T) {
+    s, err := New(t.TempDir(), 1<<20, "v1")
+    if err != nil {
+        t.Fatal(err)
+    }
+    a, b := key(s, "a"), key(s, "b")
+    s.store(a, outcome("a"))
+    s.store(b, outcome("b"))
+    if err := os.WriteFile(s.path(a), []byte("{"), 0o644); err != nil {
+        t.Fatal(err)
+    }
+    if err := os.Remove(s.path(b)); err != nil {
+        t.Fatal(err)
+    }
+    for _, k := range []string{a, b} {
+        if _, ok := s.Load(k); ok {
+            t.Error("a broken outcome is loaded")
+        }
+        if _, ok := s.entries[k]; ok {
+            t.Error("a broken outcome is kept")
+        }
+    }
+    if s.size != 0 || s.order.Len() != 0 {
+        t.Errorf("size %d of %d outcomes, expected none", s.size,
+            s.order.Len())
+    }
+    if _, err := os.Stat(s.path(a)); !os.IsNotExist(err) {
+        t.Errorf("the corrupt file is kept: %v", err)
+    }
+}
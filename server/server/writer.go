@@ -0,0 +1,109 @@
+package server
+
+import (
+    "encoding/json"
+    "log"
+    "time"
+
+    "golang.org/x/net/websocket"
+
+    "asyonline/server/server/message"
+    "asyonline/server/server/reply"
+)
+
+const (
+    // number of messages that may wait to be written
+    outboxSize = 16
+    // how long Close waits for queued messages to be written
+    closeTimeout time.Duration = 5e9 // 5s
+)
+
+// outMessage is a text message together with the binary messages that
+// must follow it. Only the send loop writes to the websocket, so that
+// these are never interleaved with other messages.
+type outMessage = struct {
+    text  string
+    blobs [][]byte
+}
+
+var errClosed = reply.Error("Connection is closed")
+
+// send queues a message to be written, blocking while the queue is full
+func (conn *Conn) send(text string, blobs ...[]byte) error {
+    select {
+    case <-conn.closing:
+        return errClosed
+    case <-conn.broken:
+        return errClosed
+    default:
+    }
+    select {
+    case conn.outbox <- outMessage{text, blobs}:
+        return nil
+    case <-conn.closing:
+        return errClosed
+    case <-conn.broken:
+        return errClosed
+    }
+}
+
+func (conn *Conn) sendJSON(msg *message.Message, blobs ...[]byte) error {
+    msgB, err := json.Marshal(msg)
+    if err != nil {
+        return err
+    }
+    return conn.send(string(msgB), blobs...)
+}
+
+func (conn *Conn) sendLoop() {
+    defer close(conn.sent)
+    var write = func(msg outMessage) bool {
+        if err := websocket.Message.Send(conn.ws, msg.text); err != nil {
+            log.Println("websocket send:", err)
+            return false
+        }
+        for _, blob := range msg.blobs {
+            if err := websocket.Message.Send(conn.ws, blob); err != nil {
+                log.Println("websocket send:", err)
+                return false
+            }
+        }
+        return true
+    }
+    for {
+        select {
+        case msg := <-conn.outbox:
+            if !write(msg) {
+                close(conn.broken)
+                conn.Stop()
+                return
+            }
+        case <-conn.closing:
+            // write what was queued before closing
+            for {
+                select {
+                case msg := <-conn.outbox:
+                    if !write(msg) {
+                        close(conn.broken)
+                        return
+                    }
+                default:
+                    return
+                }
+            }
+        }
+    }
+}
+
+// Close writes all queued messages, then closes the websocket connection
+// and stops conn. Messages that are sent after Close are discarded.
+func (conn *Conn) Close() {
+    conn.closeOnce.Do(func() { close(conn.closing) })
+    select {
+    case <-conn.sent:
+    case <-time.After(closeTimeout):
+        log.Print("websocket send: timed out on close")
+    }
+    conn.Stop()
+    conn.ws.Close()
+}